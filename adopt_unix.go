@@ -0,0 +1,46 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// adoptedFds - inherited file descriptors that have already been taken by a server
+var adoptedFds = struct {
+	sync.Mutex
+	fds map[int]bool
+}{fds: make(map[int]bool)}
+
+// adoptFd - turns the inherited listening socket fd into a listener, the caller holds adoptedFds.
+// The fd is closed, and marked as taken, whether or not it's a listener.
+func adoptFd(fd int, name string) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), name)
+	listen, err := net.FileListener(f) // dups the fd
+	f.Close()
+	adoptedFds.fds[fd] = true
+	if err != nil {
+		return nil, err
+	}
+
+	return listen, nil
+}
+
+// boundAddress - returns the unix socket path fd is bound to, abstract names start with @
+func boundAddress(fd int) string {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return ""
+	}
+
+	unixAddr, ok := sa.(*syscall.SockaddrUnix)
+	if !ok {
+		return ""
+	}
+
+	return unixAddr.Name
+}
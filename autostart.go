@@ -0,0 +1,251 @@
+package ipc
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AutoStart - starts the server when a client finds nobody listening, like gpg-agent.
+//
+// The first client to get the start lock launches the server and waits for it to listen, other
+// clients keep waiting for the socket as usual. The lock is named after the socket and kept in
+// $XDG_RUNTIME_DIR, or the temp directory, so the client doesn't create anything in the server's
+// socket directory.
+type AutoStart struct {
+	// Command - the server program and its arguments. It's started in its own session with stdin
+	// and stdout on the null device. Its stderr is a pipe the client reads until the server lets
+	// go of it or exits, the end of it is reported if the server fails to start. A server started
+	// with the library lets go when it listens if ServerConfig.ReleaseStderr is set, others should
+	// point their stderr elsewhere once running. A server that doesn't listen within Timeout is killed.
+	Command []string
+	// Spawn - starts the server instead of Command, eg. by re-executing this program or asking a
+	// service manager. It should return once the server has been launched.
+	Spawn func() error
+	// Timeout - how long to wait for the server to listen, defaults to 10s
+	Timeout time.Duration
+}
+
+// ErrAutoStart - matched by errors.Is for every AutoStartError
+var ErrAutoStart = errors.New("unable to start the server")
+
+// AutoStartError - returned by the client when AutoStart couldn't get a server listening
+type AutoStartError struct {
+	Err    error  // what went wrong, eg. the server exited or timed out
+	Stderr string // the end of the server's stderr, empty when Spawn is used
+}
+
+func (e *AutoStartError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("%v: %v", ErrAutoStart, e.Err)
+	}
+	return fmt.Sprintf("%v: %v\n%s", ErrAutoStart, e.Err, e.Stderr)
+}
+
+func (e *AutoStartError) Unwrap() error {
+	return ErrAutoStart
+}
+
+// autoStartServer - launches the server and returns a connection to it. Returns nil, nil if another
+// client holds the start lock, the caller then waits for the server like any other.
+func (cc *Client) autoStartServer() (net.Conn, error) {
+	if len(cc.autoStart.Command) == 0 && cc.autoStart.Spawn == nil {
+		return nil, &AutoStartError{Err: errors.New("neither Command nor Spawn is set")}
+	}
+
+	lock, err := os.OpenFile(cc.autoStartLockPath(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, &AutoStartError{Err: err}
+	}
+	defer lock.Close()
+
+	err = lockFile(lock)
+	if err == ErrInstanceLocked {
+		return nil, nil
+	} else if err != nil {
+		return nil, &AutoStartError{Err: err}
+	}
+
+	// the server may have been started while this client waited for the lock
+	conn, err := cc.dialOnce()
+	if err == nil || !isNotListening(err) {
+		return conn, err
+	}
+
+	exited := make(chan error, 1)
+	var stderr *stderrTail
+	var cmd *exec.Cmd
+
+	if len(cc.autoStart.Command) > 0 {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, &AutoStartError{Err: err}
+		}
+
+		cmd = exec.Command(cc.autoStart.Command[0], cc.autoStart.Command[1:]...)
+		cmd.Env = append(os.Environ(), autoStartEnv+"=1")
+		cmd.Stderr = w
+		detachProcess(cmd)
+
+		err = cmd.Start()
+		w.Close() // the server has its own copy
+		if err != nil {
+			r.Close()
+			return nil, &AutoStartError{Err: err}
+		}
+
+		// read until the server closes its end, closing ours early would kill it with SIGPIPE
+		stderr = newStderrTail()
+		go stderr.drain(r)
+
+		go func() {
+			exited <- cmd.Wait()
+		}()
+	} else if err := cc.autoStart.Spawn(); err != nil {
+		return nil, &AutoStartError{Err: err}
+	}
+
+	timeout := cc.autoStart.Timeout
+	if timeout <= 0 {
+		timeout = autoStartTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		conn, err := cc.dialOnce()
+		if err == nil {
+			return conn, nil
+		} else if !isNotListening(err) {
+			return nil, err
+		}
+
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("the server exited without listening")
+			}
+			stderr.wait(autoStartPoll) // the last of it may still be in the pipe
+			return nil, &AutoStartError{Err: err, Stderr: stderr.String()}
+		default:
+		}
+
+		if time.Now().After(deadline) {
+			if cmd != nil {
+				// the server is killed rather than left behind, which also ends the cmd.Wait go routine
+				cmd.Process.Kill()
+				<-exited
+				stderr.wait(autoStartPoll)
+			}
+			return nil, &AutoStartError{Err: fmt.Errorf("the server didn't listen within %v", timeout), Stderr: stderr.String()}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), autoStartPoll)
+		if waiter, ok := cc.transport.(listenWaiter); ok {
+			waiter.waitListening(ctx, cc.name)
+		} else {
+			<-ctx.Done()
+		}
+		cancel()
+	}
+}
+
+// autoStartLockPath - the start lock is named after a hash of the socket address, so every client of
+// this user waiting for the same server shares it. It goes in a directory the user owns, the uid
+// keeps users apart in the shared temp directory.
+func (cc *Client) autoStartLockPath() string {
+	address := cc.name
+	if addresser, ok := cc.transport.(listenAddresser); ok {
+		address = addresser.listenAddress(cc.name)
+	}
+	sum := sha256.Sum256([]byte(address))
+
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, fmt.Sprintf("psk-local-ipc-%x.start.lock", sum[:8]))
+	}
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf("psk-local-ipc-%d-%x.start.lock", os.Getuid(), sum[:8]))
+}
+
+// stderrTail - the last maxStderrLength bytes the server wrote to its stderr
+type stderrTail struct {
+	mutex sync.Mutex
+	data  []byte
+	done  chan struct{} // closed when the server closes its end
+}
+
+func newStderrTail() *stderrTail {
+	return &stderrTail{done: make(chan struct{})}
+}
+
+// drain - reads r until the server moves its stderr to the null device or exits
+func (tail *stderrTail) drain(r *os.File) {
+	defer close(tail.done)
+	defer r.Close()
+
+	buff := make([]byte, 1024)
+	for {
+		n, err := r.Read(buff)
+
+		tail.mutex.Lock()
+		tail.data = append(tail.data, buff[:n]...)
+		if len(tail.data) > maxStderrLength {
+			tail.data = append([]byte(nil), tail.data[len(tail.data)-maxStderrLength:]...)
+		}
+		tail.mutex.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// wait - waits up to timeout for the server to close its end
+func (tail *stderrTail) wait(timeout time.Duration) {
+	if tail == nil {
+		return
+	}
+
+	select {
+	case <-tail.done:
+	case <-time.After(timeout):
+	}
+}
+
+func (tail *stderrTail) String() string {
+	if tail == nil {
+		return ""
+	}
+
+	tail.mutex.Lock()
+	defer tail.mutex.Unlock()
+
+	return strings.TrimSpace(string(tail.data))
+}
+
+// releaseAutoStartStderr - a server launched by AutoStart's Command has the client's pipe as its
+// stderr, once it listens the pipe is swapped for the null device so the client can stop reading.
+// Only done when the server asks for it with ServerConfig.ReleaseStderr.
+func releaseAutoStartStderr(release bool) error {
+	if os.Getenv(autoStartEnv) == "" {
+		return nil
+	}
+	os.Unsetenv(autoStartEnv) // not for the server's own children
+
+	if !release {
+		return nil
+	}
+
+	if info, err := os.Stderr.Stat(); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		return nil // not the client's pipe, eg. redirected by whoever runs the Command
+	}
+
+	return nullStderr()
+}
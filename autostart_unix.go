@@ -0,0 +1,28 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// detachProcess - the server gets its own session so it outlives the client's terminal
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// nullStderr - points fd 2 at the null device, closing the server's end of the pipe
+func nullStderr() error {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+
+	return unix.Dup2(int(null.Fd()), int(os.Stderr.Fd()))
+}
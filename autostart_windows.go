@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// detachProcess - the server gets its own process group so it isn't sent the client's ctrl-c
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// nullStderr - points the std error handle and os.Stderr at the null device and closes the pipe
+func nullStderr() error {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := windows.SetStdHandle(windows.STD_ERROR_HANDLE, windows.Handle(null.Fd())); err != nil {
+		null.Close()
+		return err
+	}
+
+	stderr := os.Stderr
+	os.Stderr = null
+
+	return stderr.Close()
+}
@@ -1,6 +1,19 @@
 package ipc
 
-import "net"
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/jc-lab/go-tls-psk"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
 
 type ServerChannel struct {
 	path   string
@@ -18,3 +31,186 @@ type ListenConfig struct {
 func (sc *ServerChannel) Addr() net.Addr {
 	return sc.addr
 }
+
+// ErrNoChannel - returned by ChildChannel when the process wasn't started by SpawnWithChannel
+var ErrNoChannel = errors.New("the process wasn't started with SpawnWithChannel")
+
+// SpawnWithChannel - starts cmd with a private ipc channel to it, the child calls ChildChannel to
+// get the other end.
+//
+// The channel is a socketpair so there is nothing on the filesystem for other processes to find.
+// One end of it and a pipe carrying a random psk are passed through cmd.ExtraFiles, only their fd
+// numbers go in the environment. config may be nil, its PskConfig is replaced and the Transport
+// and socket settings are ignored. The returned client can't re-connect.
+func SpawnWithChannel(cmd *exec.Cmd, config *ClientConfig) (*Client, error) {
+	if cmd == nil {
+		return nil, errors.New("cmd is required")
+	}
+
+	clientConfig := ClientConfig{}
+	if config != nil {
+		clientConfig = *config
+	}
+
+	key := make([]byte, derivedKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	clientConfig.PskConfig = channelPskConfig(key)
+
+	local, remote, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+
+	pskRead, pskWrite, err := os.Pipe()
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	defer pskRead.Close()
+
+	// the key is smaller than the pipe buffer so it can be written before the child starts
+	_, err = pskWrite.Write(key)
+	pskWrite.Close()
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	socketFd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, remote, pskRead)
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d,%d", channelEnv, socketFd, socketFd+1))
+
+	if err := cmd.Start(); err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	conn, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClientFromConn(conn, &clientConfig)
+}
+
+// ChildChannel - the child's end of the channel created by SpawnWithChannel, returns ErrNoChannel if
+// the process wasn't started that way.
+//
+// The server has exactly one Connection, to the parent. config may be nil, its PskConfig is replaced
+// and the Transport and socket settings are ignored.
+func ChildChannel(config *ServerConfig) (*Server, error) {
+	value, ok := os.LookupEnv(channelEnv)
+	if !ok {
+		return nil, ErrNoChannel
+	}
+	os.Unsetenv(channelEnv) // not for our own children
+
+	fds := strings.Split(value, ",")
+	if len(fds) != 2 {
+		return nil, fmt.Errorf("invalid %s: %q", channelEnv, value)
+	}
+
+	socketFd, err := strconv.Atoi(fds[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", channelEnv, err)
+	}
+	pskFd, err := strconv.Atoi(fds[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", channelEnv, err)
+	}
+
+	pskFile := os.NewFile(uintptr(pskFd), "psk-local-ipc-channel-psk")
+	socketFile := os.NewFile(uintptr(socketFd), "psk-local-ipc-channel")
+	if pskFile == nil || socketFile == nil {
+		return nil, fmt.Errorf("invalid %s: %q", channelEnv, value)
+	}
+
+	key := make([]byte, derivedKeySize)
+	_, err = io.ReadFull(pskFile, key)
+	pskFile.Close()
+	if err != nil {
+		socketFile.Close()
+		return nil, fmt.Errorf("unable to read the channel psk: %w", err)
+	}
+
+	conn, err := net.FileConn(socketFile)
+	socketFile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	serverConfig := ServerConfig{}
+	if config != nil {
+		serverConfig = *config
+	}
+	serverConfig.PskConfig = channelPskConfig(key)
+
+	return ServeListener(newConnListener(conn), &serverConfig)
+}
+
+func channelPskConfig(key []byte) tls.PSKConfig {
+	return tls.PSKConfig{
+		GetIdentity: func() string {
+			return channelIdentity
+		},
+		GetKey: func(id string) ([]byte, error) {
+			if subtle.ConstantTimeCompare([]byte(id), []byte(channelIdentity)) != 1 {
+				return nil, errors.New("INVALID IDENTITY: " + id)
+			}
+			return key, nil
+		},
+	}
+}
+
+// connListener - accepts a single connection that already exists
+type connListener struct {
+	conn chan net.Conn
+	addr net.Addr
+	done chan struct{}
+	once sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{conn: make(chan net.Conn, 1), addr: conn.LocalAddr(), done: make(chan struct{})}
+	l.conn <- conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case conn := <-l.conn:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		select {
+		case conn := <-l.conn: // never accepted
+			conn.Close()
+		default:
+		}
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"os"
+	"syscall"
+)
+
+// socketPair - returns both ends of a connected unix stream socket pair
+func socketPair() (*os.File, *os.File, error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+
+	return os.NewFile(uintptr(fds[0]), "psk-local-ipc-channel"), os.NewFile(uintptr(fds[1]), "psk-local-ipc-channel"), nil
+}
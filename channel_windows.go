@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import (
+	"errors"
+	"os"
+)
+
+// socketPair - windows has no socketpair and ExtraFiles isn't supported
+func socketPair() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("SpawnWithChannel is not supported on windows")
+}
@@ -2,8 +2,12 @@ package ipc
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"github.com/jc-lab/go-tls-psk"
+	"io"
+	"net"
+	"os"
 	"strings"
 	"time"
 )
@@ -24,13 +28,60 @@ func StartClient(ipcName string, config *ClientConfig) (*Client, error) {
 		return nil, err
 	}
 
+	name, abstract, err := splitAbstractName(ipcName, config.Abstract)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := newClient(name, abstract, config)
+
+	go startClient(cc)
+
+	return cc, nil
+
+}
+
+// NewClientFromConn - starts the ipc client on a connection created elsewhere, eg. inherited from a
+// parent process or handed over by a sandbox broker. The tls psk layer and the ipc handshake are
+// applied to conn, the Transport and socket settings in config are ignored.
+// The client can't re-connect, it's closed when conn is.
+func NewClientFromConn(conn net.Conn, config *ClientConfig) (*Client, error) {
+	if config == nil {
+		return nil, errors.New("config is required")
+	}
+
+	if conn == nil {
+		return nil, errors.New("conn is required")
+	}
+
+	cc := newClient(conn.RemoteAddr().String(), false, config)
+	cc.transport = &connTransport{conn: conn}
+
+	go startClient(cc)
+
+	return cc, nil
+}
+
+func newClient(name string, abstract bool, config *ClientConfig) *Client {
 	cc := &Client{
 		socketDirectory: config.SocketDirectory,
-		name:            ipcName,
+		name:            name,
+		abstract:        abstract,
+		peerPolicy:      config.PeerPolicy,
+		transport:       config.Transport,
 		status:          NotConnected,
 		recieved:        make(chan *Message),
 		toWrite:         make(chan *Message),
 		pskConfig:       config.PskConfig,
+
+		sharedMemorySize:      config.SharedMemorySize,
+		sharedMemoryThreshold: config.SharedMemoryThreshold,
+
+		autoStart: config.AutoStart,
+	}
+
+	if cc.transport == nil {
+		cc.transport = defaultClientTransport(cc.abstract, config)
 	}
 
 	if config == nil {
@@ -50,15 +101,11 @@ func StartClient(ipcName string, config *ClientConfig) (*Client, error) {
 		}
 	}
 
-	go startClient(cc)
-
-	return cc, nil
-
+	return cc
 }
 
 func startClient(cc *Client) {
-	cc.status = Connecting
-	cc.recieved <- &Message{Status: cc.status, MsgType: -1}
+	cc.recieved <- &Message{Status: cc.setStatus(Connecting), MsgType: -1}
 
 	err := cc.createConnection()
 	if err != nil {
@@ -68,13 +115,19 @@ func startClient(cc *Client) {
 
 	go cc.read()
 	go cc.write()
+
+	cc.offerSharedMemory()
 }
 
 func (cc *Client) read() {
+	conn, _ := cc.connection() // reconnect() replaces cc.conn and cc.shm before this returns
+	shm := cc.sharedMemory()
+	defer shm.close()
+
 	bLen := make([]byte, 4)
 
 	for {
-		res := cc.readData(bLen)
+		res := cc.readData(conn, bLen)
 		if res == false {
 			break
 		}
@@ -83,34 +136,43 @@ func (cc *Client) read() {
 
 		msgRecvd := make([]byte, mLen)
 
-		res = cc.readData(msgRecvd)
+		res = cc.readData(conn, msgRecvd)
 		if res == false {
 			break
 		}
 
 		if bytesToInt(msgRecvd[:4]) == 0 {
+			if len(msgRecvd) == 5 && msgRecvd[4] == controlGoodbye {
+				// the server is handing over, the new process is already holding the socket
+				conn.Close()
+				go cc.reconnect()
+				break
+			}
+
 			//  type 0 = control message
+			cc.control(shm, msgRecvd[4:])
 		} else {
-			cc.recieved <- &Message{Status: cc.status, Data: msgRecvd[4:], MsgType: bytesToInt(msgRecvd[:4])}
+			cc.recieved <- &Message{Status: cc.Status(), Data: msgRecvd[4:], MsgType: bytesToInt(msgRecvd[:4])}
 		}
 	}
 }
 
-func (cc *Client) readData(buff []byte) bool {
-	_, err := cc.conn.Read(buff)
+func (cc *Client) readData(conn net.Conn, buff []byte) bool {
+	_, err := io.ReadFull(conn, buff)
 	if err != nil {
+		status := cc.Status()
+
 		if strings.Contains(err.Error(), "EOF") { // the Connection has been closed by the client.
-			cc.conn.Close()
+			conn.Close()
 
-			if cc.status != Closing || cc.status == Closed {
+			if status != Closing {
 				go cc.reconnect()
 			}
 			return false
 		}
 
-		if cc.status == Closing {
-			cc.status = Closed
-			cc.recieved <- &Message{Status: cc.status, MsgType: -1}
+		if status == Closing {
+			cc.recieved <- &Message{Status: cc.setStatus(Closed), MsgType: -1}
 			cc.recieved <- &Message{err: errors.New("Client has closed the Connection"), MsgType: -2}
 			return false
 		}
@@ -124,21 +186,24 @@ func (cc *Client) readData(buff []byte) bool {
 }
 
 func (cc *Client) reconnect() {
-	cc.status = ReConnecting
-	cc.recieved <- &Message{Status: cc.status, MsgType: -1}
+	cc.recieved <- &Message{Status: cc.setStatus(ReConnecting), MsgType: -1}
 
 	err := cc.createConnection() // connect to the pipe
 	if err != nil {
 		if err.Error() == "Timed out trying to connect" {
-			cc.status = Timeout
-			cc.recieved <- &Message{Status: cc.status, MsgType: -1}
+			cc.recieved <- &Message{Status: cc.setStatus(Timeout), MsgType: -1}
 			cc.recieved <- &Message{err: errors.New("Timed out trying to re-connect"), MsgType: -2}
+		} else {
+			cc.recieved <- &Message{Status: cc.setStatus(Closed), MsgType: -1}
+			cc.recieved <- &Message{err: err, MsgType: -2}
 		}
 
 		return
 	}
 
 	go cc.read()
+
+	cc.offerSharedMemory()
 }
 
 func (cc *Client) createConnection() error {
@@ -146,6 +211,43 @@ func (cc *Client) createConnection() error {
 	if err != nil {
 		return err
 	}
+
+	err = cc.secureConnection(conn)
+	if err != nil && isPacketConn(conn) && cc.Status() != Closing {
+		// whatever went wrong on the seqpacket socket, the stream socket is tried before giving up
+		if dialer, ok := cc.transport.(streamDialer); ok {
+			conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			conn, err = dialer.dialStream(ctx, cc.name)
+			cancel()
+			if err == nil {
+				err = cc.secureConnection(conn)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	cc.recieved <- &Message{Status: cc.setStatus(Connected), MsgType: -1}
+
+	return nil
+}
+
+// secureConnection - runs the tls and ipc handshakes over conn
+func (cc *Client) secureConnection(conn net.Conn) error {
+	if cc.peerPolicy != nil {
+		peer, _ := peerCredentials(conn)
+		if err := cc.peerPolicy(peer); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	conn = wrapFileConn(conn)
+	files, _ := conn.(fileConn)
+
 	tlsConfig := &tls.Config{
 		MinVersion: tls.VersionTLS10,
 		MaxVersion: tls.VersionTLS12,
@@ -158,15 +260,27 @@ func (cc *Client) createConnection() error {
 		InsecureSkipVerify: true,
 		Extra:              cc.pskConfig,
 	}
-	cc.conn = tls.Client(conn, tlsConfig)
+	if isPacketConn(conn) {
+		conn = newPacketStream(conn)
+	}
+	secure := tls.Client(conn, tlsConfig)
 
-	err = cc.handshake()
+	// set before the handshake so Close() can interrupt it
+	cc.mutex.Lock()
+	cc.conn = secure
+	cc.files = files
+	cc.mutex.Unlock()
+
+	err := cc.handshake()
 	if err != nil {
 		return err
 	}
 
-	cc.status = Connected
-	cc.recieved <- &Message{Status: cc.status, MsgType: -1}
+	shm := newSharedMemory(secure, files, cc.sharedMemorySize, cc.sharedMemoryThreshold)
+
+	cc.mutex.Lock()
+	cc.shm = shm
+	cc.mutex.Unlock()
 
 	return nil
 }
@@ -198,16 +312,25 @@ func (cc *Client) Write(msgType int, message []byte) error {
 		return errors.New("Message type 0 is reserved")
 	}
 
-	if cc.status != Connected {
-		return errors.New(cc.status.String())
+	cc.mutex.Lock()
+	status, maxMsgSize := cc.status, cc.maxMsgSize
+	cc.mutex.Unlock()
+
+	if status != Connected {
+		return errors.New(status.String())
 	}
 
 	mlen := len(message)
-	if mlen > cc.maxMsgSize {
+	if mlen > maxMsgSize {
 		return errors.New("Message exceeds maximum message length")
 	}
 
-	cc.toWrite <- &Message{MsgType: msgType, Data: message}
+	sent := cc.sharedMemory().write(msgType, message, func(frame []byte) {
+		cc.toWrite <- &Message{MsgType: 0, Data: frame}
+	})
+	if !sent {
+		cc.toWrite <- &Message{MsgType: msgType, Data: message}
+	}
 
 	return nil
 
@@ -221,9 +344,15 @@ func (cc *Client) write() {
 			break
 		}
 
+		conn, files := cc.connection()
+
+		if len(m.Files) > 0 {
+			files.queueFiles(m.Files)
+		}
+
 		toSend := intToBytes(m.MsgType)
 
-		writer := bufio.NewWriter(cc.conn)
+		writer := bufio.NewWriter(conn)
 
 		toSend = append(toSend, m.Data...)
 
@@ -237,14 +366,166 @@ func (cc *Client) write() {
 	}
 }
 
+// SendFiles - writes a message together with open files, eg. memfds, pipes or sockets (unix sockets only).
+// The reciever gets them in Message.Files. The files are duplicated, the caller can close its copies straight away.
+func (cc *Client) SendFiles(msgType int, message []byte, files []*os.File) error {
+
+	if msgType == 0 {
+		return errors.New("Message type 0 is reserved")
+	}
+
+	cc.mutex.Lock()
+	status, maxMsgSize, conn, fc := cc.status, cc.maxMsgSize, cc.conn, cc.files
+	cc.mutex.Unlock()
+
+	if status != Connected {
+		return errors.New(status.String())
+	}
+
+	if fc == nil {
+		return ErrFilePassingNotSupported
+	}
+
+	if len(message) > maxMsgSize {
+		return errors.New("Message exceeds maximum message length")
+	}
+
+	frame, dups, err := encodeFilesFrame(conn, msgType, message, files)
+	if err != nil {
+		return err
+	}
+
+	cc.toWrite <- &Message{MsgType: 0, Data: frame, Files: dups}
+
+	return nil
+}
+
+// control - handles a type 0 control message, shm is the connection's shared memory
+func (cc *Client) control(shm *sharedMemory, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	conn, fc := cc.connection()
+
+	switch data[0] {
+	case controlFiles:
+		msgType, message, files, err := decodeFilesFrame(conn, fc, data)
+		if err != nil {
+			conn.Close() // read() re-connects
+			return
+		}
+
+		if msgType == 0 { // a control message carrying files
+			if reply := shm.acceptOffer(message, files); reply != nil {
+				go cc.sendControl(reply, nil)
+			}
+			return
+		}
+
+		cc.recieved <- &Message{Status: cc.Status(), Data: message, MsgType: msgType, Files: files}
+
+	case controlShmAccept:
+		shm.peerAccepted()
+
+	case controlShmData:
+		msgType, message, release, err := shm.read(data)
+		if err != nil {
+			conn.Close() // read() re-connects
+			return
+		}
+
+		go cc.sendControl(release, nil)
+
+		cc.recieved <- &Message{Status: cc.Status(), Data: message, MsgType: msgType}
+
+	case controlShmRelease:
+		shm.release(data)
+	}
+}
+
+// offerSharedMemory - hands this side's shared memory ring to the server
+func (cc *Client) offerSharedMemory() {
+	shm := cc.sharedMemory()
+	if shm == nil {
+		return
+	}
+
+	conn, _ := cc.connection()
+	frame, files, err := shm.offer(conn)
+	if err != nil {
+		return
+	}
+
+	cc.sendControl(frame, files)
+}
+
+// sharedMemory - the shared memory of the current connection, nil if there isn't any
+func (cc *Client) sharedMemory() *sharedMemory {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	return cc.shm
+}
+
+// sendControl - queues a control message, it's dropped if the client isn't connected
+func (cc *Client) sendControl(frame []byte, files []*os.File) {
+	if cc.Status() != Connected {
+		closeFiles(files)
+		return
+	}
+
+	cc.toWrite <- &Message{MsgType: 0, Data: frame, Files: files}
+}
+
 // Status - returns the current Connection status as a string
 func (cc *Client) Status() Status {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
 	return cc.status
 }
 
+// setStatus - changes the status, returns it for the message that reports it
+func (cc *Client) setStatus(status Status) Status {
+	cc.mutex.Lock()
+	cc.status = status
+	cc.mutex.Unlock()
+
+	return status
+}
+
+// connection - the current connection and its file passing, nil until the first connection
+func (cc *Client) connection() (net.Conn, fileConn) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	return cc.conn, cc.files
+}
+
+// ExportKeyingMaterial - derives length bytes of keying material bound to the current tls psk session (RFC 5705).
+// The server side Connection derives the same bytes from the same label and context, the bytes change when the client re-connects.
+func (cc *Client) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	cc.mutex.Lock()
+	status, conn := cc.status, cc.conn
+	cc.mutex.Unlock()
+
+	if status != Connected {
+		return nil, errors.New(status.String())
+	}
+
+	return exportKeyingMaterial(conn, label, context, length)
+}
+
 // Close - closes the Connection
 func (cc *Client) Close() {
 
+	cc.mutex.Lock()
 	cc.status = Closing
-	cc.conn.Close()
+	conn := cc.conn
+	cc.mutex.Unlock()
+
+	if conn != nil { // nil until the first connection
+		conn.Close()
+	}
 }
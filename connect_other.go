@@ -4,79 +4,507 @@
 package ipc
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
 	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
-	"time"
 )
 
-func buildPipePath(prefix string, name string) string {
+func buildPipePath(prefix string, name string, abstract bool) string {
+	if abstract {
+		return "@" + name
+	}
+
 	base := prefix
 	if base == "" {
 		base = "/tmp/"
 	} else if !strings.HasSuffix(base, "/") {
 		base += "/"
 	}
-	return base + name + ".sock"
+	return shortenSocketPath(base+name+".sock", base, name)
+}
+
+// UnixTransport - unix socket files, <Directory>/<name>.sock - for unix and linux.
+//
+// The server creates Directory if it's missing and refuses to use it if another user could replace
+// the socket. The shared /tmp/ default isn't checked.
+type UnixTransport struct {
+	Directory string // defaults to /tmp/
+	UseUnmask bool   // the socket gets the permissions 0777 &^ Unmask, the process umask isn't touched
+	Unmask    int
+	Mode      os.FileMode // permissions of the socket file, takes precedence over Unmask
+	Owner     string      // user name or uid given the socket file
+	Group     string      // group name or gid given the socket file
+
+	DirectoryMode  os.FileMode // permissions Directory is created with, and that the client allows, defaults to 0700
+	DirectoryOwner string      // client side - user name or uid that must own Directory, not checked if empty
+}
+
+// defaultTransport - the Transport used when the server config doesn't set one
+func defaultTransport(abstract bool, config *ServerConfig) Transport {
+	if abstract {
+		return AbstractTransport{}
+	}
+
+	transport := UnixTransport{
+		Directory:     runtimeDirectory(config.SocketDirectory, config.AppName),
+		UseUnmask:     config.UseUnmask,
+		Unmask:        config.Unmask,
+		Mode:          config.SocketMode,
+		Owner:         config.SocketOwner,
+		Group:         config.SocketGroup,
+		DirectoryMode: config.DirectoryMode,
+	}
+
+	if config.Seqpacket {
+		return SeqpacketTransport{transport}
+	}
+
+	return transport
 }
 
-// Server create a unix socket and start listening connections - for unix and linux
-func (sc *Server) createListenSocket() (net.Listener, error) {
-	sockPath := buildPipePath(sc.socketDirectory, sc.name)
+// defaultClientTransport - the Transport used when the client config doesn't set one
+func defaultClientTransport(abstract bool, config *ClientConfig) Transport {
+	if abstract {
+		return AbstractTransport{}
+	}
+
+	directory := runtimeDirectory(config.SocketDirectory, config.AppName)
+
+	owner := config.DirectoryOwner
+	if owner == "" && config.SocketDirectory == "" && directory != "" {
+		owner = strconv.Itoa(os.Geteuid()) // $XDG_RUNTIME_DIR belongs to this user
+	}
+
+	transport := UnixTransport{Directory: directory, DirectoryOwner: owner, DirectoryMode: config.DirectoryMode}
+
+	if config.Seqpacket {
+		return SeqpacketTransport{transport}
+	}
+
+	return transport
+}
 
-	if err := os.RemoveAll(sockPath); err != nil {
+// Listen - create a unix socket and start listening connections
+func (t UnixTransport) Listen(name string) (net.Listener, error) {
+	return t.listen(t.listenAddress(name), "unix")
+}
+
+// listen - creates the socket file at sockPath for network, unix (stream) or unixpacket (seqpacket)
+func (t UnixTransport) listen(sockPath string, network string) (net.Listener, error) {
+	if err := t.prepareDirectory(); err != nil {
+		return nil, err
+	}
+
+	if err := removeStaleSocket(sockPath); err != nil {
 		return nil, err
 	}
 
-	var oldUmask int
-	if sc.unMask >= 0 {
-		oldUmask = syscall.Umask(sc.unMask)
+	mode, chmod := t.Mode, t.Mode != 0
+	if !chmod && t.UseUnmask {
+		mode, chmod = 0777&^os.FileMode(t.Unmask), true // an Unmask of 0777 gives mode 0, which is still applied
+	}
+
+	if !chmod && t.Owner == "" && t.Group == "" {
+		return listenUnix(sockPath, network)
+	}
+
+	return listenWithPermissions(sockPath, network, mode, chmod, t.Owner, t.Group)
+}
+
+// SeqpacketTransport - unix SOCK_SEQPACKET sockets, <Directory>/<name>.seqpacket, otherwise the same
+// as UnixTransport (linux).
+//
+// Seqpacket sockets keep message boundaries and can be half closed. The usual tls psk session runs
+// over them, its records written as packets of up to 32KiB. A server using it listens on the
+// usual stream socket as well, where seqpacket isn't supported it only has the stream socket.
+//
+// Clients only use the seqpacket socket when they ask for it, with ClientConfig.Seqpacket or a
+// SeqpacketTransport, and only if it's owned by this user, DirectoryOwner or root. If it can't be
+// connected to or a handshake fails on it the client connects to the stream socket instead.
+type SeqpacketTransport struct {
+	UnixTransport
+}
+
+// Listen - create the seqpacket socket, StartServer and AddListener create the stream one beside it
+func (t SeqpacketTransport) Listen(name string) (net.Listener, error) {
+	return t.listen(t.listenAddress(name), "unixpacket")
+}
+
+func (t SeqpacketTransport) listenAddress(name string) string {
+	return seqpacketPath(t.UnixTransport.listenAddress(name))
+}
+
+// Dial - connect to the server's seqpacket socket, or its stream socket if that fails
+func (t SeqpacketTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	if t.DirectoryOwner != "" {
+		if err := t.checkDirectoryOwner(); err != nil {
+			return nil, err
+		}
+	}
+
+	path := t.listenAddress(name)
+	if t.checkSocketOwner(path) == nil {
+		if conn, err := dialUnixNetwork(ctx, path, "unixpacket"); err == nil {
+			return conn, nil
+		}
+	}
+
+	return t.dialStream(ctx, name)
+}
+
+// dialStream - connect to the stream socket, used when the seqpacket one can't be
+func (t SeqpacketTransport) dialStream(ctx context.Context, name string) (net.Conn, error) {
+	return t.UnixTransport.Dial(ctx, name)
+}
+
+// checkSocketOwner - the socket at path must belong to this user, DirectoryOwner or root, so it
+// can't be one put in a shared directory by someone else
+func (t UnixTransport) checkSocketOwner(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s isn't a socket", path)
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Uid) == os.Geteuid() || stat.Uid == 0 {
+		return nil
+	}
+
+	if t.DirectoryOwner != "" {
+		if uid, err := lookupID(t.DirectoryOwner, lookupUser); err == nil && int(stat.Uid) == uid {
+			return nil
+		}
 	}
 
-	listen, err := net.Listen("unix", sockPath)
+	return fmt.Errorf("%s is owned by uid %d", path, stat.Uid)
+}
 
-	if sc.unMask >= 0 {
-		syscall.Umask(oldUmask)
+// seqpacketPath - the seqpacket socket that sits next to the stream socket file at sockPath
+func seqpacketPath(sockPath string) string {
+	return strings.TrimSuffix(sockPath, ".sock") + ".seqpacket"
+}
+
+// splitSeqpacket - a SeqpacketTransport server listens with its UnixTransport too, for the clients
+// that can't use seqpacket. Returns transport and nil for every other transport.
+func splitSeqpacket(transport Transport) (Transport, Transport) {
+	if t, ok := transport.(SeqpacketTransport); ok {
+		return t.UnixTransport, t
 	}
+	return transport, nil
+}
+
+// isSeqpacketUnsupported - reports whether err means the os can't create seqpacket sockets
+func isSeqpacketUnsupported(err error) bool {
+	return errors.Is(err, syscall.EPROTONOSUPPORT) || errors.Is(err, syscall.ESOCKTNOSUPPORT) || errors.Is(err, syscall.EPROTOTYPE)
+}
+
+// listenWithPermissions - binds the socket inside a private 0700 directory, sets its permissions
+// (if chmod is set) and ownership there, then links it into place. Nobody can connect before the
+// permissions are set and, unlike umask, nothing else in the process is affected.
+func listenWithPermissions(sockPath string, network string, mode os.FileMode, chmod bool, owner string, group string) (net.Listener, error) {
+	uid, gid := -1, -1
 
+	if owner != "" {
+		id, err := lookupID(owner, lookupUser)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket owner: %w", err)
+		}
+		uid = id
+	}
+
+	if group != "" {
+		id, err := lookupID(group, lookupGroup)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket group: %w", err)
+		}
+		gid = id
+	}
+
+	// same directory so the socket can be linked rather than copied
+	tempDir, err := os.MkdirTemp(filepath.Dir(sockPath), ".psk-local-ipc-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	tempPath := filepath.Join(tempDir, "s.sock")
+
+	address, done, err := unixAddress(tempPath)
+	if err != nil {
+		return nil, err
+	}
+
+	listen, err := net.ListenUnix(network, &net.UnixAddr{Name: address, Net: network})
+	done()
+	if err != nil {
+		return nil, err
+	}
+	listen.SetUnlinkOnClose(false) // the temporary directory is removed anyway
+
+	if chmod {
+		err = os.Chmod(tempPath, mode.Perm())
+	}
+	if err == nil && (uid != -1 || gid != -1) {
+		err = os.Lchown(tempPath, uid, gid)
+	}
+	if err == nil {
+		// link rather than rename, a socket created since the stale check isn't replaced
+		err = os.Link(tempPath, sockPath)
+	}
 	if err != nil {
+		listen.Close()
 		return nil, err
 	}
 
-	return listen, nil
+	return newUnlinkListener(listen, sockPath), nil
+}
+
+// lookupID - numeric ids are used as they are, names are looked up
+func lookupID(name string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(id)
+}
+
+func lookupUser(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroup(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
 }
 
-// Client connect to the unix socket created by the server -  for unix and linux
-func (cc *Client) dial() (net.Conn, error) {
-	pipePath := buildPipePath(cc.socketDirectory, cc.name)
+// unlinkListener - removes the socket file when the listener is closed, as long as it's still the
+// one this listener created. A socket that has been replaced, eg. by a server started after this
+// one was thought to be dead, is left alone.
+type unlinkListener struct {
+	net.Listener
+	path string
+	dev  uint64
+	ino  uint64
+	once sync.Once
+}
 
-	startTime := time.Now()
+// newUnlinkListener - records the inode of the socket file at path, listen must not unlink it itself
+func newUnlinkListener(listen *net.UnixListener, path string) *unlinkListener {
+	listen.SetUnlinkOnClose(false)
 
-	for {
-		if cc.timeout != 0 {
-			if time.Now().Sub(startTime).Seconds() > cc.timeout {
-				cc.status = Closed
-				return nil, errors.New("Timed out trying to connect")
-			}
+	l := &unlinkListener{Listener: listen, path: path}
+	l.dev, l.ino, _ = fileInode(path)
+
+	return l
+}
+
+func (l *unlinkListener) Close() error {
+	l.once.Do(func() {
+		if dev, ino, err := fileInode(l.path); err == nil && dev == l.dev && ino == l.ino {
+			os.Remove(l.path)
 		}
+	})
+	return l.Listener.Close()
+}
 
-		conn, err := net.Dial("unix", pipePath)
-		if err == nil {
-			return conn, nil
-		} else {
-			if strings.Contains(err.Error(), "connect: no such file or directory") == true {
+// fileInode - the device and inode of path, without following symlinks
+func fileInode(path string) (uint64, uint64, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, errors.New("no inode for " + path)
+	}
+
+	return uint64(stat.Dev), uint64(stat.Ino), nil
+}
+
+// removeStaleSocket - unlinks the socket file left at path by a server that has gone. Returns
+// ErrAlreadyRunning if a server still answers on it, and refuses to remove anything that isn't a
+// socket owned by this user, eg. a symlink or a regular file.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to remove %s, it isn't a socket", path)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("refusing to remove %s, it's owned by uid %d", path, stat.Uid)
+	}
+
+	// a bare connect, the server doesn't report connections closed before the secure handshake
+	ctx, cancel := context.WithTimeout(context.Background(), staleSocketTimeout)
+	conn, err := dialUnix(ctx, path)
+	cancel()
+	if err == nil {
+		conn.Close()
+		return ErrAlreadyRunning
+	}
+
+	if errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) { // eg. the backlog is full, someone is there
+		return fmt.Errorf("unable to tell if %s is stale: %w", path, err)
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
 
-			} else if strings.Contains(err.Error(), "connect: Connection refused") == true {
+func (t UnixTransport) listenAddress(name string) string {
+	return buildPipePath(t.Directory, name, false)
+}
+
+// prepareDirectory - creates the socket directory if it's missing and checks it can be trusted
+func (t UnixTransport) prepareDirectory() error {
+	if t.Directory == "" {
+		return nil
+	}
 
-			} else {
-				cc.recieved <- &Message{err: err, MsgType: -2}
-			}
+	return secureDirectory(t.Directory, t.DirectoryMode)
+}
+
+// Dial - connect to the unix socket created by the server
+func (t UnixTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	if t.DirectoryOwner != "" {
+		if err := t.checkDirectoryOwner(); err != nil {
+			return nil, err
 		}
+	}
+
+	return dialUnix(ctx, buildPipePath(t.Directory, name, false))
+}
+
+// waitListening - returns as soon as the socket file is created (linux), or when ctx is done
+func (t UnixTransport) waitListening(ctx context.Context, name string) {
+	waitForSocket(ctx, buildPipePath(t.Directory, name, false))
+}
+
+// listenUnix - binds the socket file at path, which can be longer than sun_path
+func listenUnix(path string, network string) (net.Listener, error) {
+	address, done, err := unixAddress(path)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 
-		time.Sleep(cc.retryTimer * time.Second)
+	listen, err := net.ListenUnix(network, &net.UnixAddr{Name: address, Net: network})
+	if err != nil {
+		return nil, err
+	}
 
+	// not unlinked by net, address may be a /proc path that no longer points at the directory
+	return newUnlinkListener(listen, path), nil
+}
+
+// dialUnix - connects to the socket file at path. Seqpacket sockets refuse stream connections with
+// EPROTOTYPE, the dial is then repeated as seqpacket.
+func dialUnix(ctx context.Context, path string) (net.Conn, error) {
+	conn, err := dialUnixNetwork(ctx, path, "unix")
+	if errors.Is(err, syscall.EPROTOTYPE) {
+		return dialUnixNetwork(ctx, path, "unixpacket")
 	}
 
+	return conn, err
+}
+
+// dialUnixNetwork - connects to the socket file at path, which can be longer than sun_path
+func dialUnixNetwork(ctx context.Context, path string, network string) (net.Conn, error) {
+	address, done, err := unixAddress(path)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// checkDirectoryOwner - the server's directory must belong to DirectoryOwner and only be writable
+// by others as far as DirectoryMode allows, a missing directory returns ENOENT so the client keeps
+// waiting for the server.
+func (t UnixTransport) checkDirectoryOwner() error {
+	uid, err := lookupID(t.DirectoryOwner, lookupUser)
+	if err != nil {
+		return fmt.Errorf("invalid directory owner: %w", err)
+	}
+
+	directory := t.Directory
+	if directory == "" {
+		directory = "/tmp/"
+	}
+
+	return checkDirectory(directory, uid, t.DirectoryMode)
+}
+
+// probeSocket - reports whether a server answers on the socket file at path, or if it's certainly gone.
+// Like removeStaleSocket it only connects, which the server doesn't report, and only to a socket
+// owned by this user.
+func probeSocket(path string) (bool, bool) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, true
+	} else if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false, false
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Geteuid() {
+		return false, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), staleSocketTimeout)
+	defer cancel()
+
+	conn, err := dialUnix(ctx, path)
+	if err == nil {
+		conn.Close()
+		return true, false
+	}
+
+	return false, errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// isNotListening - reports whether a dial error means the server isn't there (yet)
+func isNotListening(err error) bool {
+	return errors.Is(err, ErrNotListening) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, syscall.ECONNREFUSED) // abstract sockets, tcp and stale socket files
 }
@@ -4,15 +4,16 @@
 package ipc
 
 import (
+	"context"
 	"errors"
 	"net"
 	"strings"
-	"time"
+	"syscall"
 
 	"github.com/Microsoft/go-winio"
 )
 
-func buildPipePath(prefix string, name string) string {
+func buildPipePath(prefix string, name string, abstract bool) string {
 	base := prefix
 	if base == "" {
 		base = `\\.\pipe\`
@@ -22,49 +23,71 @@ func buildPipePath(prefix string, name string) string {
 	return base + name
 }
 
-// Server function
-// Create the named pipe (if it doesn't already exist) and start listening for a client to connect.
-// when a client connects and Connection is accepted the read function is called on a go routine.
-func (sc *Server) createListenSocket() (net.Listener, error) {
-	pipePath := buildPipePath(sc.socketDirectory, sc.name)
+// PipeTransport - windows named pipes, <Directory><name>
+type PipeTransport struct {
+	Directory          string // defaults to \\.\pipe\
+	SecurityDescriptor string // SDDL applied to the pipe
+}
+
+// defaultTransport - the Transport used when the server config doesn't set one
+func defaultTransport(abstract bool, config *ServerConfig) Transport {
+	return PipeTransport{Directory: config.SocketDirectory, SecurityDescriptor: config.SecurityDescriptor}
+}
+
+// defaultClientTransport - the Transport used when the client config doesn't set one
+func defaultClientTransport(abstract bool, config *ClientConfig) Transport {
+	return PipeTransport{Directory: config.SocketDirectory}
+}
+
+// splitSeqpacket - there are no seqpacket sockets, the transport is used as it is
+func splitSeqpacket(transport Transport) (Transport, Transport) {
+	return transport, nil
+}
+
+// isSeqpacketUnsupported - seqpacket sockets are never asked for
+func isSeqpacketUnsupported(err error) bool {
+	return false
+}
+
+// Listen - create the named pipe (if it doesn't already exist) and start listening for a client to connect.
+func (t PipeTransport) Listen(name string) (net.Listener, error) {
+	pipePath := buildPipePath(t.Directory, name, false)
 
 	pipeConfig := &winio.PipeConfig{}
 
-	if sc.securityDescriptor != "" {
-		pipeConfig.SecurityDescriptor = sc.securityDescriptor
+	if t.SecurityDescriptor != "" {
+		pipeConfig.SecurityDescriptor = t.SecurityDescriptor
 	}
 
 	listen, err := winio.ListenPipe(pipePath, pipeConfig)
 	if err != nil {
+		// the first instance of a pipe can't be created while another server has it
+		timeout := staleSocketTimeout
+		conn, dialErr := winio.DialPipe(pipePath, &timeout)
+		if dialErr == nil {
+			conn.Close()
+			return nil, ErrAlreadyRunning
+		}
 		return nil, err
 	}
 
 	return listen, nil
 }
 
-// Client function
-// dial - attempts to connect to a named pipe created by the server
-func (cc *Client) dial() (net.Conn, error) {
-	pipePath := buildPipePath(cc.socketDirectory, cc.name)
-
-	startTime := time.Now()
+// Dial - attempts to connect to a named pipe created by the server
+func (t PipeTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, buildPipePath(t.Directory, name, false))
+}
 
-	for {
-		if cc.timeout != 0 {
-			if time.Now().Sub(startTime).Seconds() > cc.timeout {
-				cc.status = Closed
-				return nil, errors.New("Timed out trying to connect")
-			}
-		}
-		pn, err := winio.DialPipe(pipePath, nil)
-		if err == nil {
-			return pn, nil
-		} else {
-			if !strings.Contains(err.Error(), "The system cannot find the file specified.") {
-				return nil, err
-			}
-		}
+// probeSocket - reports whether a server answers on the socket file at path, or if it's certainly gone.
+// Manifests are only written for unix socket files.
+func probeSocket(path string) (bool, bool) {
+	return false, false
+}
 
-		time.Sleep(cc.retryTimer * time.Second)
-	}
+// isNotListening - reports whether a dial error means the server isn't there (yet)
+func isNotListening(err error) bool {
+	return errors.Is(err, ErrNotListening) ||
+		errors.Is(err, syscall.ERROR_FILE_NOT_FOUND) ||
+		errors.Is(err, syscall.Errno(10061)) // WSAECONNREFUSED - tcp
 }
@@ -0,0 +1,139 @@
+package ipc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// control messages are sent with message type 0, the first byte of the data is the control type.
+// Older peers ignore type 0 messages.
+const (
+	controlFiles = 1 // a message carrying file descriptors
+)
+
+const filesMacLabel = "EXPORTER-psk-local-ipc-files" // exported keying material label for the files MAC
+
+const fileMetaSize = 20 // dev (8), inode (8), mode (4)
+
+// ErrFilePassingNotSupported - returned by SendFiles when the transport isn't a unix socket
+var ErrFilePassingNotSupported = errors.New("file descriptor passing is not supported by this transport")
+
+// fileConn - implemented by raw connections that can carry file descriptors next to the tls stream
+type fileConn interface {
+	// queueFiles - the files are sent, and closed, with the next write
+	queueFiles(files []*os.File)
+	// takeFiles - removes n recieved files from the front of the queue
+	takeFiles(n int) ([]*os.File, error)
+}
+
+// encodeFilesFrame - builds the control message announcing files. The files are duplicated so the
+// caller can close them as soon as SendFiles returns.
+//
+// byte 0 = controlFiles, bytes 1-4 = message type, byte 5 = file count, then the dev/inode/mode of
+// every file, a HMAC-SHA256 over all of that keyed from the tls session, then the message data.
+func encodeFilesFrame(conn net.Conn, msgType int, message []byte, files []*os.File) ([]byte, []*os.File, error) {
+	if len(files) == 0 || len(files) > maxPassedFiles {
+		return nil, nil, fmt.Errorf("between 1 and %d files can be sent with a message", maxPassedFiles)
+	}
+
+	key, err := exportKeyingMaterial(conn, filesMacLabel, nil, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	frame := []byte{controlFiles}
+	frame = append(frame, intToBytes(msgType)...)
+	frame = append(frame, byte(len(files)))
+
+	for _, f := range files {
+		dev, ino, mode, err := fileIdentity(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		frame = appendFileMeta(frame, dev, ino, mode)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(frame)
+	frame = mac.Sum(frame)
+
+	dups, err := dupFiles(files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(frame, message...), dups, nil
+}
+
+// decodeFilesFrame - checks a files control message against the MAC and the recieved descriptors
+func decodeFilesFrame(conn net.Conn, recvFiles fileConn, frame []byte) (int, []byte, []*os.File, error) {
+	if recvFiles == nil {
+		return 0, nil, nil, ErrFilePassingNotSupported
+	}
+
+	if len(frame) < 6 {
+		return 0, nil, nil, errors.New("files message is too short")
+	}
+
+	count := int(frame[5])
+	macEnd := 6 + count*fileMetaSize + sha256.Size
+	if count == 0 || count > maxPassedFiles || len(frame) < macEnd {
+		return 0, nil, nil, errors.New("files message is too short")
+	}
+
+	// always take the descriptors so they can't be mistaken for the next message's
+	files, err := recvFiles.takeFiles(count)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	key, err := exportKeyingMaterial(conn, filesMacLabel, nil, 32)
+	if err != nil {
+		closeFiles(files)
+		return 0, nil, nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(frame[:macEnd-sha256.Size])
+	if !hmac.Equal(mac.Sum(nil), frame[macEnd-sha256.Size:macEnd]) {
+		closeFiles(files)
+		return 0, nil, nil, errors.New("files message failed verification")
+	}
+
+	for i, f := range files {
+		dev, ino, mode, err := fileIdentity(f)
+		if err != nil {
+			closeFiles(files)
+			return 0, nil, nil, err
+		}
+
+		meta := frame[6+i*fileMetaSize : 6+(i+1)*fileMetaSize]
+		if binary.BigEndian.Uint64(meta[0:8]) != dev ||
+			binary.BigEndian.Uint64(meta[8:16]) != ino ||
+			binary.BigEndian.Uint32(meta[16:20]) != mode {
+			closeFiles(files)
+			return 0, nil, nil, errors.New("recieved files don't match the files message")
+		}
+	}
+
+	return bytesToInt(frame[1:5]), frame[macEnd:], files, nil
+}
+
+func appendFileMeta(b []byte, dev uint64, ino uint64, mode uint32) []byte {
+	meta := make([]byte, fileMetaSize)
+	binary.BigEndian.PutUint64(meta[0:8], dev)
+	binary.BigEndian.PutUint64(meta[8:16], ino)
+	binary.BigEndian.PutUint32(meta[16:20], mode)
+	return append(b, meta...)
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,110 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// runtimeDirectory - $XDG_RUNTIME_DIR/<appName> when both are set, otherwise directory
+func runtimeDirectory(directory string, appName string) string {
+	if directory != "" || appName == "" {
+		return directory
+	}
+
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return ""
+	}
+
+	return filepath.Join(runtimeDir, appName)
+}
+
+// secureDirectory - creates directory with mode if it's missing, then checks it can be trusted
+func secureDirectory(directory string, mode os.FileMode) error {
+	if mode == 0 {
+		mode = directoryMode
+	}
+
+	if err := checkPathComponents(directory); err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(directory); os.IsNotExist(err) {
+		if err := os.MkdirAll(directory, mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chmod(directory, mode.Perm()); err != nil { // undo the umask
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return checkDirectory(directory, os.Geteuid(), mode)
+}
+
+// checkDirectory - directory must be owned by uid (or root), and no one else can be able to write to it
+// unless mode allows them to or it's sticky like /tmp, where only the owner can replace a file.
+func checkDirectory(directory string, uid int, mode os.FileMode) error {
+	if err := checkPathComponents(directory); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(directory)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%w: %s isn't a directory", ErrInsecureDirectory, directory)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != uid && stat.Uid != 0 {
+		return fmt.Errorf("%w: %s is owned by uid %d", ErrInsecureDirectory, directory, stat.Uid)
+	}
+
+	if writable := info.Mode().Perm() & 0022 &^ mode.Perm(); writable != 0 && info.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("%w: %s can be written to by other users (%v)", ErrInsecureDirectory, directory, info.Mode().Perm())
+	}
+
+	return nil
+}
+
+// checkPathComponents - refuses symlinks in the path unless root owns them, eg. /var on macOS
+func checkPathComponents(directory string) error {
+	path, err := filepath.Abs(directory)
+	if err != nil {
+		return err
+	}
+
+	current := "/"
+	for _, component := range strings.Split(path, "/") {
+		if component == "" {
+			continue
+		}
+		current = filepath.Join(current, component)
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil // created by secureDirectory
+		} else if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Uid != 0 {
+			return fmt.Errorf("%w: %s is a symlink", ErrInsecureDirectory, current)
+		}
+	}
+
+	return nil
+}
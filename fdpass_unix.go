@@ -0,0 +1,188 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// fdConn - unix socket that sends queued files as SCM_RIGHTS with the next write and collects
+// any files recieved while reading.
+type fdConn struct {
+	*net.UnixConn
+	mutex    sync.Mutex
+	pending  []*os.File
+	recieved []*os.File
+	oob      []byte
+}
+
+// wrapFileConn - adds file passing to unix socket connections, other connections are returned as they are
+func wrapFileConn(conn net.Conn) net.Conn {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn
+	}
+
+	return &fdConn{UnixConn: unixConn, oob: make([]byte, syscall.CmsgSpace(maxPassedFiles*4))}
+}
+
+func (c *fdConn) queueFiles(files []*os.File) {
+	c.mutex.Lock()
+	c.pending = append(c.pending, files...)
+	c.mutex.Unlock()
+}
+
+func (c *fdConn) takeFiles(n int) ([]*os.File, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.recieved) < n {
+		return nil, errors.New("files message recieved without the file descriptors")
+	}
+
+	files := c.recieved[:n:n]
+	c.recieved = c.recieved[n:]
+
+	return files, nil
+}
+
+func (c *fdConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	files := c.pending
+	c.pending = nil
+	c.mutex.Unlock()
+
+	if len(files) == 0 {
+		return c.UnixConn.Write(b)
+	}
+
+	defer closeFiles(files)
+
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+
+	n, _, err := c.UnixConn.WriteMsgUnix(b, syscall.UnixRights(fds...), nil)
+	if err == nil && n < len(b) {
+		var m int
+		m, err = c.UnixConn.Write(b[n:])
+		n += m
+	}
+
+	return n, err
+}
+
+func (c *fdConn) Read(b []byte) (int, error) {
+	n, oobn, _, _, err := c.UnixConn.ReadMsgUnix(b, c.oob)
+	if oobn > 0 {
+		c.collect(c.oob[:oobn])
+	}
+	if n < 0 { // ReadMsgUnix passes on recvmsg's -1
+		n = 0
+	}
+
+	return n, err
+}
+
+// collect - queues the files from SCM_RIGHTS control messages
+func (c *fdConn) collect(oob []byte) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+
+			if len(c.recieved) >= maxQueuedFiles { // the peer isn't announcing what it sends
+				syscall.Close(fd)
+				continue
+			}
+			c.recieved = append(c.recieved, os.NewFile(uintptr(fd), "ipc-recieved-file"))
+		}
+	}
+}
+
+func (c *fdConn) Close() error {
+	c.mutex.Lock()
+	closeFiles(c.pending)
+	closeFiles(c.recieved)
+	c.pending = nil
+	c.recieved = nil
+	c.mutex.Unlock()
+
+	return c.UnixConn.Close()
+}
+
+// fileIdentity - returns what the files message records about f
+func fileIdentity(f *os.File) (uint64, uint64, uint32, error) {
+	var stat syscall.Stat_t
+
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var statErr error
+	err = rawConn.Control(func(fd uintptr) {
+		statErr = syscall.Fstat(int(fd), &stat)
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if statErr != nil {
+		return 0, 0, 0, statErr
+	}
+
+	return uint64(stat.Dev), uint64(stat.Ino), uint32(stat.Mode), nil
+}
+
+// dupFiles - duplicates files so they stay open until they have been written
+func dupFiles(files []*os.File) ([]*os.File, error) {
+	dups := make([]*os.File, 0, len(files))
+
+	for _, f := range files {
+		rawConn, err := f.SyscallConn()
+		if err != nil {
+			closeFiles(dups)
+			return nil, err
+		}
+
+		fd := -1
+		var dupErr error
+		err = rawConn.Control(func(sysfd uintptr) {
+			syscall.ForkLock.RLock()
+			fd, dupErr = syscall.Dup(int(sysfd))
+			if dupErr == nil {
+				syscall.CloseOnExec(fd)
+			}
+			syscall.ForkLock.RUnlock()
+		})
+		if err == nil {
+			err = dupErr
+		}
+		if err != nil {
+			closeFiles(dups)
+			return nil, err
+		}
+
+		dups = append(dups, os.NewFile(uintptr(fd), f.Name()))
+	}
+
+	return dups, nil
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import (
+	"net"
+	"os"
+)
+
+// wrapFileConn - named pipes can't carry file descriptors
+func wrapFileConn(conn net.Conn) net.Conn {
+	return conn
+}
+
+func fileIdentity(f *os.File) (uint64, uint64, uint32, error) {
+	return 0, 0, 0, ErrFilePassingNotSupported
+}
+
+func dupFiles(files []*os.File) ([]*os.File, error) {
+	return nil, ErrFilePassingNotSupported
+}
@@ -5,9 +5,6 @@ go 1.17
 require (
 	github.com/Microsoft/go-winio v0.4.16
 	github.com/jc-lab/go-tls-psk v1.18.3-psk.2
-)
-
-require (
-	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
-	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
+	golang.org/x/sys v0.7.0
 )
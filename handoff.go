@@ -0,0 +1,184 @@
+package ipc
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const controlGoodbye = 6 // the server is handing over to a new process, reconnect
+
+// ErrHandoffNotSupported - the listener can't be passed to another process, eg. a named pipe
+var ErrHandoffNotSupported = errors.New("the listener can't be handed off")
+
+// listenerFiler - listeners whose socket can be passed to another process
+type listenerFiler interface {
+	File() (*os.File, error)
+}
+
+// fileKeeper - listeners that remove a file when they're closed, the new process still needs it
+type fileKeeper interface {
+	keepFile()
+}
+
+// Handoff - restarts the server without dropping clients, eg. to upgrade the binary.
+//
+// The listening sockets are passed to cmd (not yet started) in ExtraFiles and PSK_LOCAL_IPC_LISTENERS,
+// StartServer and AddListener in the new process pick them up instead of creating sockets.
+// Once cmd has started this server stops accepting, the sockets stay open so new clients queue
+// until the new process accepts them and never see a refused connection. Connected clients are
+// told to reconnect, Handoff waits for them to go, up to DrainTimeout, then closes the server.
+func (sc *Server) Handoff(cmd *exec.Cmd) error {
+	sc.emitMutex.RLock()
+	listening := sc.status == Listening
+	sc.emitMutex.RUnlock()
+
+	if !listening {
+		return errors.New("the server isn't listening")
+	}
+
+	listeners := sc.Listeners()
+
+	var entries []string
+	var dups []*os.File
+	for _, l := range listeners {
+		filer, ok := l.listen.(listenerFiler)
+		if !ok {
+			closeFiles(dups)
+			return ErrHandoffNotSupported
+		}
+
+		f, err := filer.File() // a duplicate, the listener stays usable
+		if err != nil {
+			closeFiles(dups)
+			return err
+		}
+		dups = append(dups, f)
+
+		entries = append(entries, l.handoffKey()+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(withoutEnv(env, handoffEnv), handoffEnv+"="+strings.Join(entries, ","))
+
+	err := cmd.Start()
+	closeFiles(dups) // the new process has its own copies
+	if err != nil {
+		return err
+	}
+
+	for _, l := range listeners {
+		if keeper, ok := l.listen.(fileKeeper); ok {
+			keeper.keepFile()
+		}
+		l.listen.Close() // the accept loop ends, the new process holds the socket open
+	}
+
+	sc.connMutex.Lock()
+	sc.handingOff = true // connections still handshaking are told when they finish
+	connections := make([]*Connection, 0, len(sc.connections))
+	for connection := range sc.connections {
+		connections = append(connections, connection)
+	}
+	sc.connMutex.Unlock()
+
+	for _, connection := range connections {
+		connection.goodbye()
+	}
+
+	sc.drain()
+	sc.Close()
+
+	return nil
+}
+
+// goodbye - tells the client to reconnect, once. A Connection still handshaking is skipped, accept()
+// calls this again when it's connected. The frame never goes through the rate limits and is queued
+// in the background, so a client that isn't reading doesn't hold up the others.
+func (connection *Connection) goodbye() {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+
+	if connection.status != Connected || connection.goneAway {
+		return
+	}
+	connection.goneAway = true
+
+	go connection.sendControl([]byte{controlGoodbye}, nil)
+}
+
+// drain - waits for every Connection to go, the ones left after DrainTimeout are closed
+func (sc *Server) drain() {
+	deadline := time.After(sc.drainTimeout)
+
+	for {
+		sc.connMutex.Lock()
+		remaining := len(sc.connections)
+		changed := sc.connectionsChanged
+		sc.connMutex.Unlock()
+
+		if remaining == 0 {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-sc.done:
+			return
+		case <-deadline:
+			sc.connMutex.Lock()
+			for connection := range sc.connections {
+				connection.Close()
+			}
+			sc.connMutex.Unlock()
+			return
+		}
+	}
+}
+
+// handoffFds - the fds passed to this process for key (the socket path, or the name) by Handoff
+func handoffFds(key string) []int {
+	var fds []int
+
+	for _, entry := range strings.Split(os.Getenv(handoffEnv), ",") {
+		entryKey, fd, ok := parseHandoffEntry(entry)
+		if ok && entryKey == key {
+			fds = append(fds, fd)
+		}
+	}
+
+	return fds
+}
+
+// parseHandoffEntry - splits <key>=<fd>, the key is a path that may contain '=' itself
+func parseHandoffEntry(entry string) (string, int, bool) {
+	i := strings.LastIndex(entry, "=")
+	if i < 0 {
+		return "", 0, false
+	}
+
+	fd, err := strconv.Atoi(entry[i+1:])
+	if err != nil || fd < 3 {
+		return "", 0, false
+	}
+
+	return entry[:i], fd, true
+}
+
+// withoutEnv - env without any setting for key
+func withoutEnv(env []string, key string) []string {
+	out := make([]string, 0, len(env))
+	for _, e := range env {
+		if !strings.HasPrefix(e, key+"=") {
+			out = append(out, e)
+		}
+	}
+	return out
+}
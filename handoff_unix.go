@@ -0,0 +1,69 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// handoffListener - returns the listener passed for name by Server.Handoff in the old process,
+// nil if there isn't one. address is the socket file, the new server removes it when it's closed.
+func handoffListener(name string, address string) (net.Listener, error) {
+	key := address
+	if key == "" {
+		key = name
+	}
+
+	fds := handoffFds(key)
+	if len(fds) == 0 {
+		return nil, nil
+	}
+
+	adoptedFds.Lock()
+	defer adoptedFds.Unlock()
+
+	for _, fd := range fds {
+		if adoptedFds.fds[fd] {
+			continue
+		}
+
+		listen, err := adoptFd(fd, name)
+		clearHandoffEnv()
+		if err != nil {
+			return nil, err
+		}
+
+		if unixListen, ok := listen.(*net.UnixListener); ok && address != "" && !strings.HasPrefix(address, "@") {
+			return newUnlinkListener(unixListen, address), nil
+		}
+
+		return listen, nil
+	}
+
+	return nil, nil
+}
+
+// clearHandoffEnv - once every passed fd has been taken the setting is removed, so processes
+// started later don't mistake their own fds for listeners. The caller holds adoptedFds.
+func clearHandoffEnv() {
+	for _, entry := range strings.Split(os.Getenv(handoffEnv), ",") {
+		if _, fd, ok := parseHandoffEntry(entry); ok && !adoptedFds.fds[fd] {
+			return
+		}
+	}
+
+	os.Unsetenv(handoffEnv)
+}
+
+// keepFile - the socket file is handed to another process, Close mustn't remove it
+func (l *unlinkListener) keepFile() {
+	l.once.Do(func() {})
+}
+
+// File - a duplicate of the listening socket
+func (l *unlinkListener) File() (*os.File, error) {
+	return l.Listener.(*net.UnixListener).File()
+}
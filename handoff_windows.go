@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import "net"
+
+// handoffListener - named pipes can't be handed off
+func handoffListener(name string, address string) (net.Listener, error) {
+	return nil, nil
+}
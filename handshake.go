@@ -52,7 +52,9 @@ func (cc *Client) handshake() error {
 
 	var maxMsgSize uint32
 	binary.Read(bytes.NewReader(recv[4:]), binary.BigEndian, &maxMsgSize)
+	cc.mutex.Lock()
 	cc.maxMsgSize = int(maxMsgSize)
+	cc.mutex.Unlock()
 
 	cc.handshakeSendReply(0) // 0 is ok
 
@@ -1,10 +1,24 @@
 package ipc
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/jc-lab/go-tls-psk"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -69,7 +83,7 @@ func TestStartUp_Configs(t *testing.T) {
 	scon.Timeout = -1
 	scon.MaxMsgSize = -1
 
-	_, err5 := StartServer(RAND_VALUE+"test", scon)
+	_, err5 := StartServer(RAND_VALUE+"test_configs5", scon)
 	if err5 != nil {
 		t.Error(err2)
 	}
@@ -85,7 +99,7 @@ func TestStartUp_Configs(t *testing.T) {
 	scon.MaxMsgSize = 1025
 	ccon.RetryTimer = 1
 
-	_, err7 := StartServer(RAND_VALUE+"test", scon)
+	_, err7 := StartServer(RAND_VALUE+"test_configs7", scon)
 	if err7 != nil {
 		t.Error(err2)
 	}
@@ -1604,13 +1618,14 @@ func TestMultipleClientWrite(t *testing.T) {
 	clientResults := make(chan bool, 4)
 
 	go func() {
-		for {
+		for recieved := 0; recieved < 2; { // one message from each client, stop before sc.Close()
 			m, err := sc.Read()
 			if err != nil {
 				t.Error(err)
 				break
 			}
 			if m.MsgType == 1 {
+				recieved++
 				clientResults <- true
 			}
 		}
@@ -1669,3 +1684,2830 @@ func waitServerReady(t *testing.T, sc *Server) {
 		}
 	}
 }
+
+func TestDerivePSKConfig(t *testing.T) {
+	config := &PassphraseConfig{Salt: []byte("0123456789abcdef"), ScryptN: 1024}
+
+	a, err := DerivePSKConfig("name-a", []byte("correct horse"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := DerivePSKConfig("name-a", []byte("correct horse"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := DerivePSKConfig("name-b", []byte("correct horse"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.GetIdentity() != "name-a" {
+		t.Error("identity should default to the ipc name")
+	}
+
+	keyA, _ := a.GetKey(a.GetIdentity())
+	keyA2, _ := a2.GetKey(a2.GetIdentity())
+	keyB, _ := b.GetKey(b.GetIdentity())
+
+	if len(keyA) != 32 || string(keyA) != string(keyA2) {
+		t.Error("the same passphrase, salt and name should derive the same key")
+	}
+	if string(keyA) == string(keyB) {
+		t.Error("different ipc names should derive different keys")
+	}
+
+	if _, err := a.GetKey("name-b"); err == nil {
+		t.Error("should have rejected an unknown identity")
+	}
+
+	argon, err := DerivePSKConfig("name-a", []byte("correct horse"), &PassphraseConfig{
+		KDF:          Argon2id,
+		Salt:         config.Salt,
+		Argon2Memory: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyArgon, _ := argon.GetKey("name-a")
+	if len(keyArgon) != 32 || string(keyArgon) == string(keyA) {
+		t.Error("argon2id should derive its own 32 byte key")
+	}
+
+	if _, err := DerivePSKConfig("name-a", []byte("correct horse"), &PassphraseConfig{}); err == nil {
+		t.Error("should have an error because the salt is empty")
+	}
+}
+
+func TestStalledHandshake(t *testing.T) {
+	name := RAND_VALUE + "test_stall"
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, HandshakeTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	// connects but never starts the tls handshake
+	stalled, err := (&Client{name: name, retryTimer: 1, transport: defaultClientTransport(false, &ClientConfig{}), recieved: make(chan *Message, 1)}).dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	cc, err := StartClient(name, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			if _, err := cc.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	connected := false
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			if !connected {
+				t.Fatal("the stalled connection blocked the client: " + err.Error())
+			}
+			break
+		}
+		if m.Status == Connected {
+			connected = true
+		}
+	}
+
+	stats := sc.Stats()
+	if stats.HandshakesTimedOut != 1 {
+		t.Errorf("should have 1 timed out handshake, got %d", stats.HandshakesTimedOut)
+	}
+	if stats.HandshakesInProgress != 0 {
+		t.Errorf("should have no handshakes in progress, got %d", stats.HandshakesInProgress)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	name := RAND_VALUE + "test_maxconn"
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, MaxConnections: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	cc, err := StartClient(name, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	go cc.Read()
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			break
+		}
+	}
+
+	cc2, err := StartClient(name, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc2.Close()
+	go func() {
+		for {
+			if _, err := cc2.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	_, err = sc.Read()
+	limitErr, ok := err.(*LimitError)
+	if !ok || limitErr.Limit != LimitConnections || limitErr.Action != OverflowReject {
+		t.Fatalf("should have got a connections LimitError, got %v", err)
+	}
+
+	if stats := sc.Stats(); stats.Connections != 1 || stats.ConnectionsRejected < 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestMessageRateLimit(t *testing.T) {
+	name := RAND_VALUE + "test_ratelimit"
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, MessageRateLimit: 0.5, MessageBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	cc, err := StartClient(name, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	clientConnected := make(chan bool, 1)
+	go func() {
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				return
+			}
+			if m.Status == Connected {
+				clientConnected <- true
+			}
+		}
+	}()
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			break
+		}
+	}
+	<-clientConnected
+
+	cc.Write(1, []byte("one"))
+	cc.Write(1, []byte("two"))
+
+	recieved := 0
+	limited := 0
+	for recieved+limited < 2 {
+		m, err := sc.Read()
+		if err != nil {
+			if _, ok := err.(*LimitError); ok {
+				limited++
+				continue
+			}
+			t.Fatal(err)
+		}
+		if m.MsgType == 1 {
+			recieved++
+		}
+	}
+
+	if recieved != 1 || limited != 1 {
+		t.Errorf("should have recieved 1 message and rejected 1, got %d and %d", recieved, limited)
+	}
+	if sc.Stats().RateLimited != 1 {
+		t.Error("the rejected message should have been counted")
+	}
+}
+
+func TestHandshakeLockout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("peer credentials are not available for named pipes")
+	}
+
+	name := RAND_VALUE + "test_lockout"
+
+	audit := make(chan AuditEvent, 16)
+	sc, err := StartServer(name, &ServerConfig{
+		PskConfig: defaultPskConfig,
+		Lockout:   &LockoutPolicy{MaxFailures: 2, BaseDelay: time.Minute},
+		AuditHook: func(event AuditEvent) {
+			audit <- event
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	go func() {
+		for {
+			if _, err := sc.Read(); err != nil && sc.Status() == Closed {
+				return
+			}
+		}
+	}()
+
+	badConfig := &ClientConfig{PskConfig: tls.PSKConfig{
+		GetIdentity: defaultPskConfig.GetIdentity,
+		GetKey: func(identity string) ([]byte, error) {
+			return []byte("wrong"), nil
+		},
+	}}
+
+	for i := 0; i < 2; i++ {
+		cc, err := StartClient(name, badConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, err := cc.Read(); err != nil {
+				break
+			}
+		}
+
+		event := <-audit
+		if event.Type != AuditHandshakeFailed || event.Failures != i+1 || event.Peer == nil {
+			t.Fatalf("unexpected audit event %+v", event)
+		}
+	}
+
+	event := <-audit
+	if event.Type != AuditLockedOut || event.LockedUntil.IsZero() {
+		t.Fatalf("should have been locked out, got %+v", event)
+	}
+
+	// the right key doesn't help while locked out
+	cc, err := StartClient(name, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := cc.Read(); err != nil {
+			break
+		}
+	}
+
+	event = <-audit
+	if event.Type != AuditLockoutRejected {
+		t.Fatalf("should have rejected the locked out peer, got %+v", event)
+	}
+
+	stats := sc.Stats()
+	if stats.AuthFailures != 2 || stats.LockoutRejections != 1 || stats.LockedOutPeers != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDroppedHandshake(t *testing.T) {
+	name := RAND_VALUE + "test_dropped"
+
+	audit := make(chan AuditEvent, 16)
+	sc, err := StartServer(name, &ServerConfig{
+		PskConfig: defaultPskConfig,
+		Lockout:   &LockoutPolicy{MaxFailures: 1, BaseDelay: time.Minute},
+		AuditHook: func(event AuditEvent) {
+			audit <- event
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	// connect and close straight away, like a liveness probe
+	for i := 0; i < 3; i++ {
+		conn, err := (&Client{name: name, retryTimer: 1, transport: defaultClientTransport(false, &ClientConfig{}), recieved: make(chan *Message, 1)}).dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	cc, err := StartClient(name, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			if _, err := cc.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal("a dropped connection should not be reported as an error: " + err.Error())
+		}
+		if m.Status != Connecting && m.Status != Connected {
+			t.Errorf("a dropped connection should not be reported, got %s", m.Status.String())
+		}
+		if m.Status == Connected {
+			break
+		}
+	}
+
+	select {
+	case event := <-audit:
+		t.Errorf("a dropped connection should not be audited, got %+v", event)
+	default:
+	}
+
+	stats := sc.Stats()
+	if stats.AuthFailures != 0 || stats.HandshakesFailed != 0 || stats.LockedOutPeers != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestNotTLSHandshake(t *testing.T) {
+	name := RAND_VALUE + "test_not_tls"
+
+	audit := make(chan AuditEvent, 16)
+	sc, err := StartServer(name, &ServerConfig{
+		PskConfig: defaultPskConfig,
+		Lockout:   &LockoutPolicy{MaxFailures: 1, BaseDelay: time.Minute},
+		AuditHook: func(event AuditEvent) {
+			audit <- event
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	go func() {
+		for {
+			if _, err := sc.Read(); err != nil && sc.Status() == Closed {
+				return
+			}
+		}
+	}()
+
+	// something that isn't tls counts the same as a wrong key
+	conn, err := (&Client{name: name, retryTimer: 1, transport: defaultClientTransport(false, &ClientConfig{}), recieved: make(chan *Message, 1)}).dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	io.ReadAll(conn)
+	conn.Close()
+
+	select {
+	case event := <-audit:
+		if event.Type != AuditHandshakeFailed || event.Err == nil {
+			t.Errorf("unexpected audit event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed handshake should be audited")
+	}
+
+	if stats := sc.Stats(); stats.AuthFailures != 1 {
+		t.Errorf("expected 1 auth failure, got %+v", stats)
+	}
+}
+
+func TestExportKeyingMaterial(t *testing.T) {
+	name := RAND_VALUE + "test_ekm"
+
+	sc, err := StartServer(name, defaultServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	cc, err := StartClient(name, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	clientConnected := make(chan bool, 1)
+	go func() {
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				return
+			}
+			if m.Status == Connected {
+				clientConnected <- true
+			}
+		}
+	}()
+
+	var connection *Connection
+	for connection == nil {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			connection = m.Connection
+		}
+	}
+	<-clientConnected
+
+	serverKey, err := connection.ExportKeyingMaterial("EXPORTER-psk-local-ipc-test", []byte("context"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := cc.ExportKeyingMaterial("EXPORTER-psk-local-ipc-test", []byte("context"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(serverKey) != 32 || !bytes.Equal(serverKey, clientKey) {
+		t.Error("both sides should export the same keying material")
+	}
+
+	otherKey, err := cc.ExportKeyingMaterial("EXPORTER-psk-local-ipc-other", []byte("context"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(otherKey, clientKey) {
+		t.Error("a different label should export different keying material")
+	}
+}
+
+func TestAbstractSocket(t *testing.T) {
+	name := "@" + RAND_VALUE + "test_abstract"
+
+	if runtime.GOOS != "linux" {
+		if _, err := StartServer(name, defaultServerConfig); err != ErrAbstractNotSupported {
+			t.Error("should have an error because abstract sockets are linux only")
+		}
+		return
+	}
+
+	sc, err := StartServer(name, defaultServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	if _, err := os.Stat(buildPipePath("", name[1:], false)); !os.IsNotExist(err) {
+		t.Error("an abstract socket shouldn't create a socket file")
+	}
+
+	cc, err := StartClient(name, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	go func() {
+		for {
+			if _, err := cc.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			if m.Connection.PeerCredentials().UID != os.Getuid() {
+				t.Error("peer credentials should report our own uid")
+			}
+			break
+		}
+	}
+}
+
+func TestPeerPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("peer credentials are not available for named pipes")
+	}
+
+	name := RAND_VALUE + "test_peerpolicy"
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, PeerPolicy: AllowUIDs(os.Getuid() + 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	cc, err := StartClient(name, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	go func() {
+		for {
+			if _, err := cc.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	_, err = sc.Read()
+	if err == nil || err.Error() != fmt.Sprintf("peer uid %d is not allowed", os.Getuid()) {
+		t.Errorf("should have rejected our own uid, got %v", err)
+	}
+}
+
+// connectPair - starts a server and a client and waits until both sides are connected,
+// client messages after Connected are passed to clientMessages.
+func connectPair(t *testing.T, name string, serverConfig *ServerConfig, clientConfig *ClientConfig) (*Server, *Connection, *Client, chan *Message) {
+	sc, err := StartServer(name, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitServerReady(t, sc)
+
+	cc, err := StartClient(name, clientConfig)
+	if err != nil {
+		sc.Close()
+		t.Fatal(err)
+	}
+
+	clientMessages := make(chan *Message, 16)
+	clientConnected := make(chan bool, 1)
+	go func() {
+		connected := false
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				close(clientMessages)
+				return
+			}
+			if !connected && m.Status == Connected {
+				connected = true
+				clientConnected <- true
+				continue
+			}
+			if connected {
+				clientMessages <- m
+			}
+		}
+	}()
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			sc.Close()
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			<-clientConnected
+			return sc, m.Connection, cc, clientMessages
+		}
+	}
+}
+
+func testTransport(t *testing.T, name string, transport Transport) {
+	sc, connection, cc, clientMessages := connectPair(t, name,
+		&ServerConfig{PskConfig: defaultPskConfig, Transport: transport},
+		&ClientConfig{PskConfig: defaultPskConfig, Transport: transport})
+	defer sc.Close()
+	defer cc.Close()
+
+	if err := cc.Write(7, []byte("hello server")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MsgType != 7 || string(m.Data) != "hello server" {
+		t.Errorf("unexpected message %d %q", m.MsgType, m.Data)
+	}
+
+	if err := connection.Write(8, []byte("hello client")); err != nil {
+		t.Fatal(err)
+	}
+	m = <-clientMessages
+	if m == nil || m.MsgType != 8 || string(m.Data) != "hello client" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+func TestTCPLoopbackTransport(t *testing.T) {
+	testTransport(t, RAND_VALUE+"test_tcp", TCPLoopbackTransport{Directory: t.TempDir()})
+}
+
+func TestMemoryTransport(t *testing.T) {
+	testTransport(t, RAND_VALUE+"test_memory", MemoryTransport{})
+}
+
+// tracingTransport - wraps another transport, as users would to add tracing
+type tracingTransport struct {
+	Transport
+	dials int32
+}
+
+func (t *tracingTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	atomic.AddInt32(&t.dials, 1)
+	return t.Transport.Dial(ctx, name)
+}
+
+func TestWrappedTransport(t *testing.T) {
+	transport := &tracingTransport{Transport: MemoryTransport{}}
+	testTransport(t, RAND_VALUE+"test_wrapped", transport)
+
+	if atomic.LoadInt32(&transport.dials) != 1 {
+		t.Error("the wrapped transport should have been used to dial")
+	}
+}
+
+func TestMemoryTransportClientFirst(t *testing.T) {
+	name := RAND_VALUE + "test_memory_first"
+	config := &ClientConfig{PskConfig: defaultPskConfig, Transport: MemoryTransport{}, RetryTimer: 30}
+
+	cc, err := StartClient(name, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	connected := make(chan bool, 1)
+	go func() {
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				return
+			}
+			if m.Status == Connected {
+				connected <- true
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, Transport: MemoryTransport{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	go func() {
+		for {
+			if _, err := sc.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// the client must be woken by the listener rather than waiting out the 30 second retry timer
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client wasn't woken when the server started listening")
+	}
+}
+
+func TestMemoryPipe(t *testing.T) {
+	a, b := newMemoryPipe("pipe")
+	defer a.Close()
+	defer b.Close()
+
+	// writes are buffered, nobody is reading yet
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	n, err := b.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("unexpected read %q %v", buf[:n], err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := b.Read(buf); !isTimeout(err) {
+		t.Errorf("should have timed out, got %v", err)
+	}
+
+	a.Close()
+	b.SetReadDeadline(time.Time{})
+	if _, err := b.Read(buf); err != io.EOF {
+		t.Errorf("should have got EOF after the other end closed, got %v", err)
+	}
+}
+
+func TestServeListenerAndClientFromConn(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := ServeListener(listen, defaultServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := NewClientFromConn(conn, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientMessages := make(chan *Message, 8)
+	clientErr := make(chan error, 1)
+	go func() {
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				clientErr <- err
+				return
+			}
+			clientMessages <- m
+		}
+	}()
+
+	var connection *Connection
+	for connection == nil {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			connection = m.Connection
+		}
+	}
+
+	if err := connection.Write(3, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for m := range clientMessages {
+		if m.MsgType == 3 {
+			if string(m.Data) != "hello" {
+				t.Errorf("unexpected message %q", m.Data)
+			}
+			break
+		}
+	}
+
+	// the client can't dial again so it must close rather than re-connect
+	connection.Close()
+
+	select {
+	case err := <-clientErr:
+		if err != ErrCannotReconnect {
+			t.Errorf("should have got ErrCannotReconnect, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client should have closed")
+	}
+}
+
+func TestSendFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file descriptor passing needs unix sockets")
+	}
+
+	sc, connection, cc, clientMessages := connectPair(t, RAND_VALUE+"test_files", defaultServerConfig, defaultClientConfig)
+	defer sc.Close()
+	defer cc.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := cc.SendFiles(5, []byte("pipe"), []*os.File{r}); err != nil {
+		t.Fatal(err)
+	}
+	r.Close() // SendFiles sends a duplicate
+
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MsgType != 5 || string(m.Data) != "pipe" || len(m.Files) != 1 {
+		t.Fatalf("unexpected message %d %q with %d files", m.MsgType, m.Data, len(m.Files))
+	}
+	defer m.Files[0].Close()
+
+	if _, err := w.Write([]byte("through the pipe")); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 16)
+	if _, err := io.ReadFull(m.Files[0], buff); err != nil {
+		t.Fatal(err)
+	}
+	if string(buff) != "through the pipe" {
+		t.Errorf("unexpected pipe data %q", buff)
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("file contents")
+
+	if err := connection.SendFiles(6, nil, []*os.File{f, f}); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := <-clientMessages
+	if cm == nil || cm.MsgType != 6 || len(cm.Files) != 2 {
+		t.Fatalf("unexpected message %+v", cm)
+	}
+	for _, recieved := range cm.Files {
+		b := make([]byte, 13)
+		if _, err := recieved.ReadAt(b, 0); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "file contents" {
+			t.Errorf("unexpected file contents %q", b)
+		}
+		recieved.Close()
+	}
+
+	if err := cc.SendFiles(0, nil, []*os.File{f}); err == nil {
+		t.Error("message type 0 should be rejected")
+	}
+	if err := cc.SendFiles(5, nil, nil); err == nil {
+		t.Error("a message without files should be rejected")
+	}
+}
+
+func TestSendFilesRateLimited(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file descriptor passing needs unix sockets")
+	}
+
+	sc, _, cc, _ := connectPair(t, RAND_VALUE+"test_files_limit",
+		&ServerConfig{PskConfig: defaultPskConfig, MessageRateLimit: 5, MessageBurst: 1}, defaultClientConfig)
+	defer sc.Close()
+	defer cc.Close()
+
+	send := func(data string) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		w.Close()
+
+		if err := cc.SendFiles(5, []byte(data), []*os.File{r}); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+
+	// reads the next message, skipping limit errors
+	next := func() (*Message, int) {
+		limited := 0
+		for {
+			m, err := sc.Read()
+			if err != nil {
+				if _, ok := err.(*LimitError); ok {
+					limited++
+					continue
+				}
+				t.Fatal(err)
+			}
+			if m.MsgType == 5 {
+				return m, limited
+			}
+		}
+	}
+
+	send("one")
+	send("two") // over the limit, its file has to be taken off the socket anyway
+
+	m, _ := next()
+	m.Files[0].Close()
+
+	time.Sleep(300 * time.Millisecond)
+	send("three")
+
+	m, limited := next()
+	if limited != 1 {
+		t.Errorf("the second message should have been rejected, got %d limit errors", limited)
+	}
+	if string(m.Data) != "three" || len(m.Files) != 1 {
+		t.Fatalf("unexpected message %q with %d files", m.Data, len(m.Files))
+	}
+	defer m.Files[0].Close()
+
+	b, err := io.ReadAll(m.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "three" {
+		t.Errorf("the message came with the wrong file, it has %q", b)
+	}
+}
+
+func TestSendFilesNotSupported(t *testing.T) {
+	sc, connection, cc, _ := connectPair(t, RAND_VALUE+"test_files_memory",
+		&ServerConfig{PskConfig: defaultPskConfig, Transport: MemoryTransport{}},
+		&ClientConfig{PskConfig: defaultPskConfig, Transport: MemoryTransport{}})
+	defer sc.Close()
+	defer cc.Close()
+
+	if err := cc.SendFiles(5, nil, []*os.File{os.Stdin}); err != ErrFilePassingNotSupported {
+		t.Errorf("expected ErrFilePassingNotSupported, got %v", err)
+	}
+	if err := connection.SendFiles(5, nil, []*os.File{os.Stdin}); err != ErrFilePassingNotSupported {
+		t.Errorf("expected ErrFilePassingNotSupported, got %v", err)
+	}
+}
+
+// waitSharedMemory - waits until the peer has accepted shm's ring
+func waitSharedMemory(t *testing.T, shm *sharedMemory) {
+	for i := 0; i < 500; i++ {
+		shm.mutex.Lock()
+		accepted := shm.accepted
+		shm.mutex.Unlock()
+		if accepted {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("shared memory wasn't accepted")
+}
+
+func TestSharedMemory(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("shared memory needs memfd")
+	}
+
+	sc, connection, cc, clientMessages := connectPair(t, RAND_VALUE+"test_shm",
+		&ServerConfig{PskConfig: defaultPskConfig, SharedMemorySize: 1 << 20},
+		&ClientConfig{PskConfig: defaultPskConfig, SharedMemorySize: 1 << 20})
+	defer sc.Close()
+	defer cc.Close()
+
+	if connection.shm == nil || cc.shm == nil {
+		t.Fatal("shared memory should be set up on both sides")
+	}
+	waitSharedMemory(t, connection.shm)
+	waitSharedMemory(t, cc.shm)
+
+	// enough to wrap around the ring a few times
+	for i := 0; i < 10; i++ {
+		payload := make([]byte, 300*1024)
+		rand.Read(payload)
+
+		if err := cc.Write(9, payload); err != nil {
+			t.Fatal(err)
+		}
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType != 9 || !bytes.Equal(m.Data, payload) {
+			t.Fatalf("message %d was corrupted", i)
+		}
+
+		if err := connection.Write(10, payload); err != nil {
+			t.Fatal(err)
+		}
+		cm := <-clientMessages
+		if cm == nil || cm.MsgType != 10 || !bytes.Equal(cm.Data, payload) {
+			t.Fatalf("message %d to the client was corrupted", i)
+		}
+	}
+
+	if cc.shm.sendSeq != 10 || connection.shm.sendSeq != 10 {
+		t.Errorf("large messages should have gone through shared memory, sent %d and %d", cc.shm.sendSeq, connection.shm.sendSeq)
+	}
+
+	// small messages still use normal frames
+	if err := cc.Write(11, []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MsgType != 11 || string(m.Data) != "small" || cc.shm.sendSeq != 10 {
+		t.Errorf("unexpected message %d %q", m.MsgType, m.Data)
+	}
+}
+
+func TestSharedMemoryRateLimited(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("shared memory needs memfd")
+	}
+
+	sc, connection, cc, _ := connectPair(t, RAND_VALUE+"test_shm_limit",
+		&ServerConfig{PskConfig: defaultPskConfig, SharedMemorySize: 1 << 20, MessageRateLimit: 5, MessageBurst: 1},
+		&ClientConfig{PskConfig: defaultPskConfig, SharedMemorySize: 1 << 20})
+	defer sc.Close()
+	defer cc.Close()
+
+	if connection.shm == nil || cc.shm == nil {
+		t.Fatal("shared memory should be set up on both sides")
+	}
+	waitSharedMemory(t, connection.shm)
+	waitSharedMemory(t, cc.shm)
+
+	// reads the next message, counting limit errors
+	next := func() (*Message, int) {
+		limited := 0
+		for {
+			m, err := sc.Read()
+			if err != nil {
+				if _, ok := err.(*LimitError); ok {
+					limited++
+					continue
+				}
+				t.Fatal(err)
+			}
+			if m.MsgType == 9 {
+				return m, limited
+			}
+		}
+	}
+
+	payloads := make([][]byte, 3)
+	for i := range payloads {
+		payloads[i] = make([]byte, 300*1024)
+		rand.Read(payloads[i])
+	}
+
+	time.Sleep(300 * time.Millisecond) // the shared memory control frames were charged
+
+	cc.Write(9, payloads[0])
+	cc.Write(9, payloads[1]) // over the limit, dropped after it's been copied out and released
+
+	m, _ := next()
+	if !bytes.Equal(m.Data, payloads[0]) {
+		t.Fatal("the first message was corrupted")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	cc.Write(9, payloads[2])
+
+	m, limited := next()
+	if limited != 1 {
+		t.Errorf("the second message should have been rejected, got %d limit errors", limited)
+	}
+	if !bytes.Equal(m.Data, payloads[2]) {
+		t.Fatal("the third message was corrupted")
+	}
+	if cc.shm.sendSeq != 3 {
+		t.Errorf("the messages should have gone through shared memory, sent %d", cc.shm.sendSeq)
+	}
+
+	// the dropped message's space is given back too
+	for i := 0; ; i++ {
+		cc.shm.mutex.Lock()
+		inflight := len(cc.shm.inflight)
+		cc.shm.mutex.Unlock()
+
+		if inflight == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("%d messages were never released", inflight)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSharedMemoryFallback(t *testing.T) {
+	sc, connection, cc, _ := connectPair(t, RAND_VALUE+"test_shm_fallback",
+		&ServerConfig{PskConfig: defaultPskConfig, SharedMemorySize: 1 << 20},
+		defaultClientConfig)
+	defer sc.Close()
+	defer cc.Close()
+
+	payload := make([]byte, 2<<20)
+	rand.Read(payload)
+
+	if err := cc.Write(9, payload); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MsgType != 9 || !bytes.Equal(m.Data, payload) {
+		t.Fatal("large message was corrupted")
+	}
+
+	if connection.shm != nil {
+		connection.shm.mutex.Lock()
+		accepted := connection.shm.accepted
+		connection.shm.mutex.Unlock()
+		if accepted {
+			t.Error("a client without shared memory shouldn't accept the server's ring")
+		}
+	}
+}
+
+func TestSharedMemoryRing(t *testing.T) {
+	shm := &sharedMemory{ring: make([]byte, 100), accepted: true, threshold: 1, key: []byte("key")}
+
+	var frames [][]byte
+	send := func(frame []byte) {
+		frames = append(frames, frame)
+	}
+
+	if !shm.write(1, make([]byte, 60), send) || !shm.write(1, make([]byte, 30), send) {
+		t.Fatal("the messages should fit")
+	}
+	if shm.write(1, make([]byte, 20), send) {
+		t.Fatal("the ring should be full")
+	}
+
+	release := make([]byte, 9)
+	release[0] = controlShmRelease
+	release[8] = 1
+	shm.release(release)
+
+	if !shm.write(1, make([]byte, 50), send) {
+		t.Fatal("the message should wrap around to the start")
+	}
+	if offset := shm.inflight[len(shm.inflight)-1].offset; offset != 0 {
+		t.Errorf("the message should be at the start of the ring, not %d", offset)
+	}
+	if shm.write(1, make([]byte, 20), send) {
+		t.Fatal("the message would overwrite an unreleased one")
+	}
+
+	// the reciever checks the sequence and the MAC
+	peer := &sharedMemory{peerRing: shm.ring, key: []byte("key")}
+	if _, _, _, err := peer.read(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := peer.read(frames[0]); err == nil {
+		t.Error("a replayed message should be rejected")
+	}
+	frames[1][len(frames[1])-1] ^= 1
+	if _, _, _, err := peer.read(frames[1]); err == nil {
+		t.Error("a tampered message should be rejected")
+	}
+}
+
+func TestSharedMemoryWriteUnlocked(t *testing.T) {
+	shm := &sharedMemory{ring: make([]byte, 100), accepted: true, threshold: 1, key: []byte("key")}
+
+	release := make([]byte, 9)
+	release[0] = controlShmRelease
+	release[8] = 1
+
+	// send blocks until the peer reads, its release has to get through meanwhile
+	sent := shm.write(1, make([]byte, 60), func(frame []byte) {
+		released := make(chan struct{})
+		go func() {
+			shm.release(release)
+			close(released)
+		}()
+
+		select {
+		case <-released:
+		case <-time.After(5 * time.Second):
+			t.Error("release() was blocked by write() sending")
+		}
+	})
+	if !sent {
+		t.Fatal("the message should fit")
+	}
+
+	if !shm.write(1, make([]byte, 60), func([]byte) {}) {
+		t.Error("the released space should be reused")
+	}
+}
+
+// TestChannelHelper - the child side of TestSpawnWithChannel, it echos one message back to the parent
+func TestChannelHelper(t *testing.T) {
+	if os.Getenv("PSK_LOCAL_IPC_TEST_CHILD") != "1" {
+		return
+	}
+
+	sc, err := ChildChannel(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType > 0 {
+			if err := m.Connection.Write(m.MsgType+1, m.Data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if m.MsgType == -1 && m.Status == Closed {
+			return
+		}
+	}
+}
+
+func TestSpawnWithChannel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SpawnWithChannel needs socketpair")
+	}
+
+	if _, err := ChildChannel(nil); err != ErrNoChannel {
+		t.Errorf("expected ErrNoChannel, got %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestChannelHelper$")
+	cmd.Env = append(os.Environ(), "PSK_LOCAL_IPC_TEST_CHILD=1")
+	cmd.Stderr = os.Stderr
+
+	cc, err := SpawnWithChannel(cmd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		m, err := cc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			break
+		}
+	}
+
+	if err := cc.Write(4, []byte("hello child")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := cc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MsgType != 5 || string(m.Data) != "hello child" {
+		t.Errorf("unexpected reply %d %q", m.MsgType, m.Data)
+	}
+
+	cc.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("the child failed: %v", err)
+	}
+}
+
+func TestAlreadyRunning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket files are unix only")
+	}
+
+	dir := t.TempDir()
+	name := RAND_VALUE + "test_running"
+	serverConfig := &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir}
+	clientConfig := &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir}
+
+	sc, connection, cc, _ := connectPair(t, name, serverConfig, clientConfig)
+	defer sc.Close()
+	defer cc.Close()
+
+	if _, err := StartServer(name, serverConfig); err != ErrAlreadyRunning {
+		t.Fatalf("expected ErrAlreadyRunning, got %v", err)
+	}
+
+	// the first server still has its socket
+	if err := cc.Write(5, []byte("still there")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Connection != connection || string(m.Data) != "still there" {
+		t.Errorf("unexpected message %q", m.Data)
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket files are unix only")
+	}
+
+	dir := t.TempDir()
+	serverConfig := &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir}
+
+	// a socket left behind by a server that has gone
+	stale := RAND_VALUE + "test_stale"
+	listen, err := net.Listen("unix", filepath.Join(dir, stale+".sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen.(*net.UnixListener).SetUnlinkOnClose(false)
+	listen.Close()
+
+	sc, err := StartServer(stale, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Close()
+
+	// anything that isn't a socket is left alone
+	regular := RAND_VALUE + "test_regular"
+	if err := os.WriteFile(filepath.Join(dir, regular+".sock"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StartServer(regular, serverConfig); err == nil {
+		t.Error("a regular file shouldn't be replaced")
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, regular+".sock")); err != nil || string(b) != "data" {
+		t.Error("the regular file should still be there")
+	}
+
+	link := RAND_VALUE + "test_link"
+	if err := os.Symlink(filepath.Join(dir, regular+".sock"), filepath.Join(dir, link+".sock")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StartServer(link, serverConfig); err == nil {
+		t.Error("a symlink shouldn't be replaced")
+	}
+}
+
+func TestSingleInstance(t *testing.T) {
+	name := RAND_VALUE + "test_instance"
+	config := &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: t.TempDir()}
+	if runtime.GOOS == "windows" {
+		config.SocketDirectory = ""
+	}
+
+	forwarded := make(chan instanceForward, 1)
+	primary, exit, err := SingleInstance(name, config, func(args []string, cwd string) {
+		forwarded <- instanceForward{Args: args, Cwd: cwd}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit || primary == nil {
+		t.Fatal("the first instance should keep running")
+	}
+	defer primary.Close()
+
+	second, exit, err := SingleInstance(name, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exit || second != nil {
+		t.Fatal("the second instance should exit")
+	}
+
+	cwd, _ := os.Getwd()
+	select {
+	case f := <-forwarded:
+		if f.Cwd != cwd || len(f.Args) != len(os.Args)-1 {
+			t.Errorf("unexpected arguments %q from %q", f.Args, f.Cwd)
+		}
+	default:
+		t.Error("the arguments should have been handled before the second instance returned")
+	}
+}
+
+func TestSingleInstanceAppName(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket directories are unix only")
+	}
+
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+
+	name := RAND_VALUE + "test_instance_app"
+	config := &ServerConfig{PskConfig: defaultPskConfig, AppName: "psk-test", DirectoryMode: 0750}
+
+	forwarded := make(chan struct{}, 1)
+	primary, _, err := SingleInstance(name, config, func(args []string, cwd string) {
+		forwarded <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+
+	_, exit, err := SingleInstance(name, config, nil)
+	if err != nil || !exit {
+		t.Fatalf("the second instance should forward to the socket in $XDG_RUNTIME_DIR/<AppName> and exit: %v", err)
+	}
+
+	select {
+	case <-forwarded:
+	default:
+		t.Error("the arguments should have been handled before the second instance returned")
+	}
+}
+
+func TestSocketPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket files are unix only")
+	}
+
+	dir := t.TempDir()
+	clientConfig := &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir}
+
+	tests := []struct {
+		name   string
+		config *ServerConfig
+		mode   os.FileMode
+	}{
+		{"mode", &ServerConfig{SocketMode: 0600, SocketOwner: strconv.Itoa(os.Getuid()), SocketGroup: strconv.Itoa(os.Getgid())}, 0600},
+		{"unmask", &ServerConfig{UseUnmask: true, Unmask: 0077}, 0700},
+		{"both", &ServerConfig{UseUnmask: true, Unmask: 0077, SocketMode: 0660}, 0660},
+	}
+
+	for _, test := range tests {
+		name := RAND_VALUE + "test_perm_" + test.name
+		test.config.PskConfig = defaultPskConfig
+		test.config.SocketDirectory = dir
+
+		sc, connection, cc, _ := connectPair(t, name, test.config, clientConfig)
+
+		sockPath := filepath.Join(dir, name+".sock")
+		info, err := os.Lstat(sockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != test.mode {
+			t.Errorf("%s: the socket should have mode %v, not %v", test.name, test.mode, info.Mode())
+		}
+
+		if err := connection.Write(5, []byte("hello")); err != nil {
+			t.Error(err)
+		}
+
+		cc.Close()
+		sc.Close()
+
+		if _, err := os.Lstat(sockPath); !os.IsNotExist(err) {
+			t.Errorf("%s: the socket file should be removed on Close", test.name)
+		}
+	}
+
+	// an Unmask of 0777 is applied too, not left to the process umask. Only root could connect.
+	name := RAND_VALUE + "test_perm_unmask_all"
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, UseUnmask: true, Unmask: 0777})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(dir, name+".sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0 {
+		t.Errorf("the socket should have mode 0, not %v", info.Mode())
+	}
+	sc.Close()
+
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			t.Errorf("the temporary directory %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestSocketDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket directories are unix only")
+	}
+
+	base := t.TempDir()
+
+	// created when missing
+	dir := filepath.Join(base, "created", "sockets")
+	name := RAND_VALUE + "test_dir"
+	sc, _, cc, _ := connectPair(t, name,
+		&ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir},
+		&ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, DirectoryOwner: strconv.Itoa(os.Geteuid())})
+	cc.Close()
+	sc.Close()
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("the directory should be created with mode 0700, not %v", info.Mode().Perm())
+	}
+
+	// writable by others
+	open := filepath.Join(base, "open")
+	os.Mkdir(open, 0700)
+	os.Chmod(open, 0777)
+	if _, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: open}); !errors.Is(err, ErrInsecureDirectory) {
+		t.Errorf("a world writable directory should be refused, got %v", err)
+	}
+	if _, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: open, DirectoryMode: 0777}); err != nil {
+		t.Errorf("DirectoryMode should allow the directory, got %v", err)
+	}
+
+	// shared with a group, the client allows the mode the server created it with
+	shared := filepath.Join(base, "shared")
+	sharedName := RAND_VALUE + "test_dir_shared"
+	sc, _, cc, _ = connectPair(t, sharedName,
+		&ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: shared, DirectoryMode: 0770},
+		&ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: shared, DirectoryOwner: strconv.Itoa(os.Geteuid()), DirectoryMode: 0770})
+	cc.Close()
+	sc.Close()
+
+	cc, err = StartClient(sharedName, &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: shared, DirectoryOwner: strconv.Itoa(os.Geteuid())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, err := cc.Read()
+		if err != nil {
+			if !errors.Is(err, ErrInsecureDirectory) {
+				t.Errorf("a group writable directory should be refused without DirectoryMode, got %v", err)
+			}
+			break
+		}
+	}
+
+	// symlinked
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() != 0 { // root owned symlinks are trusted
+		if _, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: link}); !errors.Is(err, ErrInsecureDirectory) {
+			t.Errorf("a symlinked directory should be refused, got %v", err)
+		}
+	}
+
+	// the client checks the owner, root owned directories are trusted
+	owner := os.Geteuid() + 1
+	if os.Geteuid() == 0 {
+		if err := os.Chown(dir, 12345, -1); err != nil {
+			t.Fatal(err)
+		}
+		owner = 0
+	}
+	cc, err = StartClient(name, &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, DirectoryOwner: strconv.Itoa(owner)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, err := cc.Read()
+		if err != nil {
+			if !errors.Is(err, ErrInsecureDirectory) {
+				t.Errorf("expected ErrInsecureDirectory, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestRuntimeDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket directories are unix only")
+	}
+
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+
+	name := RAND_VALUE + "test_runtime"
+	sc, _, cc, _ := connectPair(t, name,
+		&ServerConfig{PskConfig: defaultPskConfig, AppName: "psk-test"},
+		&ClientConfig{PskConfig: defaultPskConfig, AppName: "psk-test"})
+	defer sc.Close()
+	defer cc.Close()
+
+	if _, err := os.Lstat(filepath.Join(runtimeDir, "psk-test", name+".sock")); err != nil {
+		t.Errorf("the socket should be in $XDG_RUNTIME_DIR/<AppName>: %v", err)
+	}
+}
+
+func TestIpcNameValidation(t *testing.T) {
+	for _, name := range []string{"a/b", "..", ".hidden", "a\x00b", "with space", "@", strings.Repeat("a", maxNameLength+1)} {
+		_, err := StartServer(name, defaultServerConfig)
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q should be refused, got %v", name, err)
+		}
+		var nameErr *NameError
+		if !errors.As(err, &nameErr) || nameErr.Name != name {
+			t.Errorf("%q should return a NameError, got %v", name, err)
+		}
+
+		if _, err := StartClient(name, defaultClientConfig); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("client - %q should be refused, got %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"app", "My_App-1.2", "@app", strings.Repeat("a", maxNameLength)} {
+		if err := checkIpcName(name); err != nil {
+			t.Errorf("%q should be allowed, got %v", name, err)
+		}
+	}
+}
+
+func TestLongSocketPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket files are unix only")
+	}
+
+	dir := t.TempDir()
+	for len(dir) < 150 {
+		dir = filepath.Join(dir, "a-long-directory-name")
+	}
+
+	name := RAND_VALUE + "test_long_path"
+	sc, connection, cc, clientMessages := connectPair(t, name,
+		&ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, SocketMode: 0600},
+		&ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir})
+	defer sc.Close()
+	defer cc.Close()
+
+	if err := connection.Write(5, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-clientMessages; m == nil || string(m.Data) != "hello" {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	if runtime.GOOS == "linux" {
+		if _, err := os.Lstat(filepath.Join(dir, name+".sock")); err != nil {
+			t.Errorf("the socket should keep its name: %v", err)
+		}
+	}
+}
+
+func TestCloseRemovesSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket files are unix only")
+	}
+
+	dir := t.TempDir()
+	config := &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir}
+
+	name := RAND_VALUE + "test_close"
+	sockPath := filepath.Join(dir, name+".sock")
+
+	sc, err := StartServer(name, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitServerReady(t, sc)
+	sc.Close()
+
+	if _, err := os.Lstat(sockPath); !os.IsNotExist(err) {
+		t.Error("the socket file should be removed on Close")
+	}
+
+	// a socket that has been replaced is left alone
+	sc, err = StartServer(name, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitServerReady(t, sc)
+
+	os.Remove(sockPath)
+	if err := os.WriteFile(sockPath, []byte("someone else"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sc.Close()
+
+	if _, err := os.Lstat(sockPath); err != nil {
+		t.Error("a replaced socket file shouldn't be removed on Close")
+	}
+
+	// the single instance lock is released
+	instanceName := RAND_VALUE + "test_close_instance"
+	primary, _, err := SingleInstance(instanceName, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary.server.Close()
+
+	again, exit, err := SingleInstance(instanceName, config, nil)
+	if err != nil || exit {
+		t.Fatalf("the name should be free after Close, got exit %v, %v", exit, err)
+	}
+	again.Close()
+}
+
+// TestCloseOnSignalHelper - the child side of TestCloseOnSignal, it waits to be killed
+func TestCloseOnSignalHelper(t *testing.T) {
+	dir := os.Getenv("PSK_LOCAL_IPC_TEST_SIGNAL_DIR")
+	if dir == "" {
+		return
+	}
+
+	sc, err := StartServer("signalled", &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.CloseOnSignal()
+	waitServerReady(t, sc)
+
+	os.Stdout.WriteString("ready\n")
+	time.Sleep(time.Minute)
+}
+
+func TestCloseOnSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals and socket files are unix only")
+	}
+
+	dir := t.TempDir()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCloseOnSignalHelper$")
+	cmd.Env = append(os.Environ(), "PSK_LOCAL_IPC_TEST_SIGNAL_DIR="+dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ready := make([]byte, 6)
+	if _, err := io.ReadFull(stdout, ready); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "signalled.sock")); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	err = cmd.Wait()
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || !status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Errorf("the child should have been killed by SIGTERM, got %v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "signalled.sock")); !os.IsNotExist(err) {
+		t.Error("the socket file should be removed when the server is signalled")
+	}
+}
+
+func TestUnixSocketBoundNotListening(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the socket directory is only watched on linux")
+	}
+
+	dir := t.TempDir()
+	name := RAND_VALUE + "test_bound"
+
+	// the socket file exists from bind(), connecting is refused until listen()
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: filepath.Join(dir, name+".sock")}); err != nil {
+		syscall.Close(fd)
+		t.Fatal(err)
+	}
+
+	cc, err := StartClient(name, &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, RetryTimer: 30})
+	if err != nil {
+		syscall.Close(fd)
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	connected := make(chan bool, 1)
+	go func() {
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				return
+			}
+			if m.Status == Connected {
+				connected <- true
+			}
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond) // refused at least once
+
+	if err := syscall.Listen(fd, 16); err != nil {
+		syscall.Close(fd)
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fd), "bound")
+	listen, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := ServeListener(listen, &ServerConfig{PskConfig: defaultPskConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	go func() {
+		for {
+			if _, err := sc.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client should retry shortly after being refused, not wait for RetryTimer")
+	}
+}
+
+func TestManifestDiscover(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("manifests are written for unix socket files only")
+	}
+
+	dir := t.TempDir()
+	config := &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, Manifest: true, AppVersion: "1.2.3"}
+
+	name := RAND_VALUE + "test_manifest"
+	manifestPath := filepath.Join(dir, name+".json")
+
+	sc, err := StartServer(name, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitServerReady(t, sc)
+
+	// left behind by a server that has gone
+	stalePath := filepath.Join(dir, "stale.json")
+	stale := Manifest{Marker: manifestMarker, Name: "stale", Socket: filepath.Join(dir, "stale.sock"), PID: 1}
+	data, _ := json.Marshal(&stale)
+	if err := os.WriteFile(stalePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// names a live socket outside the directory, must be ignored
+	elsewhere := t.TempDir()
+	sc2, err := StartServer(name+"_elsewhere", &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: elsewhere})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc2.Close()
+	waitServerReady(t, sc2)
+
+	forged := Manifest{Marker: manifestMarker, Name: "forged", Socket: filepath.Join(elsewhere, name+"_elsewhere.sock"), PID: os.Getpid()}
+	data, _ = json.Marshal(&forged)
+	if err := os.WriteFile(filepath.Join(dir, "forged.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// not a manifest, must be left alone
+	otherPath := filepath.Join(dir, "other.json")
+	if err := os.WriteFile(otherPath, []byte(`{"name":"other"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, err := Discover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifests) != 1 {
+		t.Fatalf("expected 1 live server, got %d", len(manifests))
+	}
+	m := manifests[0]
+	if m.Name != name || m.PID != os.Getpid() || m.UID != os.Geteuid() || m.AppVersion != "1.2.3" || m.ProtocolVersion != version {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	if m.Socket != filepath.Join(dir, name+".sock") {
+		t.Errorf("unexpected socket %s", m.Socket)
+	}
+	if m.StartTime.IsZero() {
+		t.Error("the start time should be set")
+	}
+
+	if _, err := os.Stat(stalePath); !os.IsNotExist(err) {
+		t.Error("the stale manifest should be removed")
+	}
+	if _, err := os.Stat(otherPath); err != nil {
+		t.Error("other json files should be left alone")
+	}
+
+	sc.Close()
+
+	if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Error("the manifest should be removed on Close")
+	}
+
+	manifests, err = Discover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 0 {
+		t.Errorf("expected no live servers, got %d", len(manifests))
+	}
+}
+
+func TestUnixSocketClientFirst(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the socket directory is only watched on linux")
+	}
+
+	// the directory doesn't exist until the server creates it
+	dir := filepath.Join(t.TempDir(), "later")
+	name := RAND_VALUE + "test_unix_first"
+
+	cc, err := StartClient(name, &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, RetryTimer: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	connected := make(chan bool, 1)
+	go func() {
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				return
+			}
+			if m.Status == Connected {
+				connected <- true
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	go func() {
+		for {
+			if _, err := sc.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// the client must be woken by the socket being created rather than waiting out the 30 second retry timer
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client wasn't woken when the socket was created")
+	}
+}
+
+func TestAutoStartHelper(t *testing.T) {
+	settings := os.Getenv("PSK_LOCAL_IPC_TEST_AUTOSTART")
+	if settings == "" {
+		return
+	}
+
+	parts := strings.SplitN(settings, ",", 2)
+	dir, name := parts[0], parts[1]
+
+	if name == "fail" {
+		fmt.Fprintln(os.Stderr, "daemon failed to load its config")
+		os.Exit(1)
+	}
+
+	if name == "hang" { // never listens
+		os.WriteFile(filepath.Join(dir, "hang.pid"), []byte(strconv.Itoa(os.Getpid())), 0600)
+		time.Sleep(30 * time.Second)
+		os.Exit(0)
+	}
+
+	// one line per launch
+	launches, err := os.OpenFile(filepath.Join(dir, "launches"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	launches.WriteString("launched\n")
+	launches.Close()
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, ReleaseStderr: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	// never outlive the test by long
+	time.AfterFunc(30*time.Second, func() { os.Exit(0) })
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			continue
+		}
+		if m.Status == Listening { // the client's stderr pipe should have been let go by now
+			info, err := os.Stderr.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.WriteFile(filepath.Join(dir, "stderr"), []byte(info.Mode().Type().String()), 0600)
+		}
+		if m.MsgType == 9 { // quit
+			m.Connection.Write(10, nil)
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+	}
+}
+
+func TestAutoStart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses unix socket files")
+	}
+
+	dir := t.TempDir()
+	name := RAND_VALUE + "test_autostart"
+	t.Setenv("PSK_LOCAL_IPC_TEST_AUTOSTART", dir+","+name)
+
+	autoStart := &AutoStart{Command: []string{os.Args[0], "-test.run=^TestAutoStartHelper$"}}
+
+	// several clients at once, only one of them launches the server
+	clients := make([]*Client, 3)
+	for i := range clients {
+		cc, err := StartClient(name, &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, AutoStart: autoStart, Timeout: 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[i] = cc
+	}
+
+	for _, cc := range clients {
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Status == Connected {
+				break
+			}
+		}
+	}
+
+	if err := clients[0].Write(9, []byte("quit")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := clients[0].Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType == 10 {
+			break
+		}
+	}
+	for _, cc := range clients {
+		cc.Close()
+	}
+
+	launches, err := os.ReadFile(filepath.Join(dir, "launches"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(launches), "launched"); n != 1 {
+		t.Errorf("the server should have been launched once, it was launched %d times", n)
+	}
+
+	stderrType, err := os.ReadFile(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stderrType), "p") {
+		t.Errorf("the server's stderr should be the null device once it listens, it's %q", stderrType)
+	}
+
+	// a server that fails to start is reported with its stderr
+	t.Setenv("PSK_LOCAL_IPC_TEST_AUTOSTART", dir+",fail")
+
+	cc, err := StartClient(RAND_VALUE+"test_autostart_fail", &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, AutoStart: autoStart})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	for {
+		_, err := cc.Read()
+		if err == nil {
+			continue
+		}
+
+		var startErr *AutoStartError
+		if !errors.As(err, &startErr) || !errors.Is(err, ErrAutoStart) {
+			t.Fatalf("expected an AutoStartError, got %v", err)
+		}
+		if !strings.Contains(startErr.Stderr, "daemon failed to load its config") {
+			t.Errorf("the server's stderr should be reported, got %q", startErr.Stderr)
+		}
+		break
+	}
+
+	// a server that never listens is killed once the start timeout is up
+	t.Setenv("PSK_LOCAL_IPC_TEST_AUTOSTART", dir+",hang")
+
+	hang, err := StartClient(RAND_VALUE+"test_autostart_hang", &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir,
+		AutoStart: &AutoStart{Command: autoStart.Command, Timeout: 500 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hang.Close()
+
+	for {
+		_, err := hang.Read()
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrAutoStart) || !strings.Contains(err.Error(), "didn't listen") {
+			t.Fatalf("expected the start to time out, got %v", err)
+		}
+		break
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "hang.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := strconv.Atoi(string(data))
+	if proc, err := os.FindProcess(pid); err == nil && proc.Signal(syscall.Signal(0)) == nil {
+		t.Error("the server that never listened should have been killed and reaped")
+	}
+}
+
+func TestHandoffHelper(t *testing.T) {
+	settings := os.Getenv("PSK_LOCAL_IPC_TEST_HANDOFF")
+	if settings == "" {
+		return
+	}
+
+	parts := strings.SplitN(settings, ",", 2)
+	dir, name := parts[0], parts[1]
+
+	// never outlive the test by long
+	time.AfterFunc(30*time.Second, func() { os.Exit(0) })
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	if os.Getenv(handoffEnv) != "" {
+		t.Error("the handoff setting should be removed once the listener is taken")
+	}
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			continue
+		}
+		switch m.MsgType {
+		case 5: // which process is this
+			m.Connection.Write(6, []byte(strconv.Itoa(os.Getpid())))
+		case 9: // quit
+			m.Connection.Write(10, nil)
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("named pipes can't be handed off")
+	}
+
+	dir := t.TempDir()
+	name := RAND_VALUE + "test_handoff"
+	sockPath := filepath.Join(dir, name+".sock")
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	go func() {
+		for {
+			m, err := sc.Read()
+			if err != nil {
+				if sc.Status() == Closed {
+					return
+				}
+				continue
+			}
+			if m.MsgType == 5 {
+				m.Connection.Write(6, []byte(strconv.Itoa(os.Getpid())))
+			}
+		}
+	}()
+
+	cc, err := StartClient(name, &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, RetryTimer: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	messages := make(chan *Message, 10)
+	go func() {
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				return
+			}
+			messages <- m
+		}
+	}()
+
+	// asks which process is serving the client
+	servedBy := func() string {
+		for {
+			if err := cc.Write(5, nil); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		for {
+			select {
+			case m := <-messages:
+				if m.MsgType == 6 {
+					return string(m.Data)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("no reply from the server")
+			}
+		}
+	}
+
+	if pid := servedBy(); pid != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("expected the old process to serve the client, got %s", pid)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffHelper$")
+	cmd.Env = append(os.Environ(), "PSK_LOCAL_IPC_TEST_HANDOFF="+dir+","+name)
+	cmd.Stderr = os.Stderr
+
+	handedOff := make(chan error, 1)
+	go func() {
+		handedOff <- sc.Handoff(cmd)
+	}()
+
+	select {
+	case err := <-handedOff:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("the client didn't move to the new process")
+	}
+
+	if sc.Status() != Closed {
+		t.Error("the old server should be closed once its clients have moved")
+	}
+	if _, err := os.Lstat(sockPath); err != nil {
+		t.Error("the socket file should be left for the new process")
+	}
+
+	if pid := servedBy(); pid != strconv.Itoa(cmd.Process.Pid) {
+		t.Fatalf("expected the new process to serve the client, got %s", pid)
+	}
+
+	// a new client goes straight to the new process
+	other, err := StartClient(name, &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, Timeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := other.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			break
+		}
+	}
+	other.Close()
+
+	cc.Write(9, nil)
+	cmd.Wait()
+
+	if _, err := os.Lstat(sockPath); !os.IsNotExist(err) {
+		t.Error("the new process should remove the socket file when it closes")
+	}
+}
+
+func TestHandoffDuringHandshake(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("named pipes can't be handed off")
+	}
+
+	dir := t.TempDir()
+	name := RAND_VALUE + "test_handoff_handshake"
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, DrainTimeout: 20 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	go func() {
+		for {
+			if _, err := sc.Read(); err != nil && sc.Status() == Closed {
+				return
+			}
+		}
+	}()
+
+	// accepted by the server, but the handshake hasn't started when Handoff runs
+	conn, err := net.Dial("unix", filepath.Join(dir, name+".sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	handedOff := make(chan error, 1)
+	go func() {
+		handedOff <- sc.Handoff(exec.Command(os.Args[0], "-test.run=^$"))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	cc, err := NewClientFromConn(conn, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			if _, err := cc.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-handedOff:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the client should have been told to reconnect once its handshake finished")
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("peer credentials are not available for named pipes")
+	}
+
+	dir := t.TempDir()
+	name := RAND_VALUE + "test_listeners"
+	otherName := RAND_VALUE + "test_listeners_other"
+
+	// the first listener refuses our uid, the second one allows it with a different psk
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, PeerPolicy: AllowUIDs(os.Getuid() + 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	otherPsk := tls.PSKConfig{
+		GetIdentity: func() string {
+			return "other"
+		},
+		GetKey: func(identity string) ([]byte, error) {
+			if identity == "other" {
+				return []byte("other key"), nil
+			}
+			return nil, errors.New("INVALID IDENTITY: " + identity)
+		},
+	}
+
+	other, err := sc.AddListener(otherName, &ServerConfig{PskConfig: otherPsk, SocketDirectory: dir, PeerPolicy: AllowUIDs(os.Getuid())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other.Name() != otherName || other.Addr() == nil {
+		t.Errorf("unexpected listener %s %v", other.Name(), other.Addr())
+	}
+	if listeners := sc.Listeners(); len(listeners) != 2 || listeners[1] != other {
+		t.Fatalf("expected 2 listeners, got %d", len(listeners))
+	}
+
+	cc, err := StartClient(otherName, &ClientConfig{PskConfig: otherPsk, SocketDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				return
+			}
+			if m.Status == Connected {
+				cc.Write(5, []byte("hello"))
+			}
+		}
+	}()
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType == 5 {
+			if m.Connection.Listener() != other {
+				t.Error("the connection should report the listener it came from")
+			}
+			break
+		}
+	}
+
+	// the first listener still applies its own peer policy
+	refused, err := StartClient(name, &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	go func() {
+		for {
+			if _, err := refused.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		_, err := sc.Read()
+		if err != nil {
+			if err.Error() != fmt.Sprintf("peer uid %d is not allowed", os.Getuid()) {
+				t.Errorf("should have rejected our own uid, got %v", err)
+			}
+			break
+		}
+	}
+
+	if _, err := sc.AddListener(otherName, &ServerConfig{SocketDirectory: dir}); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("expected ErrAlreadyRunning for a name that's in use, got %v", err)
+	}
+
+	sc.Close()
+
+	if _, err := os.Lstat(filepath.Join(dir, otherName+".sock")); !os.IsNotExist(err) {
+		t.Error("every listener should be closed with the server")
+	}
+}
+
+func TestSeqpacket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("seqpacket unix sockets are linux only")
+	}
+
+	dir := t.TempDir()
+	name := RAND_VALUE + "test_seqpacket"
+
+	serverConfig := &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, Seqpacket: true, MaxMsgSize: 1 << 20}
+	clientConfig := &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, Seqpacket: true}
+
+	sc, connection, cc, clientMessages := connectPair(t, name, serverConfig, clientConfig)
+	defer sc.Close()
+	defer cc.Close()
+
+	if tlsConn, ok := connection.conn.(*tls.Conn); !ok || !isPacketConn(tlsConn.NetConn()) {
+		t.Fatalf("expected tls over the seqpacket socket, got %T", connection.conn)
+	}
+	if conn, _ := cc.connection(); !isPacketConn(conn) {
+		t.Fatal("the client should have connected to the seqpacket socket")
+	}
+
+	// bigger than one packet
+	big := make([]byte, 3*maxPacketPayload+123)
+	rand.Read(big)
+
+	if err := cc.Write(5, big); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MsgType != 5 || !bytes.Equal(m.Data, big) {
+		t.Fatalf("unexpected message %d of %d bytes", m.MsgType, len(m.Data))
+	}
+
+	if err := connection.Write(6, []byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if cm := <-clientMessages; cm == nil || cm.MsgType != 6 || string(cm.Data) != "reply" {
+		t.Fatalf("unexpected reply %+v", cm)
+	}
+
+	serverKey, err := connection.ExportKeyingMaterial("EXPORTER-test", []byte("context"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := cc.ExportKeyingMaterial("EXPORTER-test", []byte("context"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serverKey, clientKey) {
+		t.Error("both sides should export the same keying material")
+	}
+
+	// file passing is keyed through the exporter, it works over seqpacket too
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := cc.SendFiles(7, []byte("pipe"), []*os.File{r}); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	m, err = sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MsgType != 7 || len(m.Files) != 1 {
+		t.Fatalf("unexpected message %d with %d files", m.MsgType, len(m.Files))
+	}
+	m.Files[0].Close()
+
+	// a client with the wrong psk is refused on the seqpacket socket, then on the stream socket
+	badClient, err := StartClient(name, &ClientConfig{SocketDirectory: dir, Seqpacket: true, PskConfig: tls.PSKConfig{
+		GetIdentity: defaultPskConfig.GetIdentity,
+		GetKey: func(identity string) ([]byte, error) {
+			return []byte("wrong"), nil
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer badClient.Close()
+
+	badDone := make(chan bool)
+	go func() {
+		defer close(badDone)
+		for {
+			if _, err := badClient.Read(); err != nil {
+				return
+			}
+		}
+	}()
+	defer func() { <-badDone }()
+
+	for failed := 0; failed < 2; {
+		if _, err := sc.Read(); err != nil {
+			failed++
+		}
+	}
+
+	if stats := sc.Stats(); stats.AuthFailures != 2 {
+		t.Errorf("the wrong psk should count as an auth failure on each socket, got %d", stats.AuthFailures)
+	}
+}
+
+func TestSeqpacketStreamClient(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("seqpacket unix sockets are linux only")
+	}
+
+	dir := t.TempDir()
+	name := RAND_VALUE + "test_seqpacket_stream"
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, Seqpacket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	if n := len(sc.Listeners()); n != 2 {
+		t.Fatalf("expected a stream and a seqpacket listener, got %d", n)
+	}
+
+	waitServerReady(t, sc)
+
+	// eg. an older client, it only knows the stream socket
+	conn, err := net.Dial("unix", filepath.Join(dir, name+".sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := NewClientFromConn(conn, defaultClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	// and one that hasn't asked for seqpacket
+	cc2, err := StartClient(name, &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc2.Close()
+
+	for _, c := range []*Client{cc, cc2} {
+		go func(c *Client) {
+			for {
+				if _, err := c.Read(); err != nil {
+					return
+				}
+			}
+		}(c)
+	}
+
+	for connected := 0; connected < 2; {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			if isPacketConn(m.Connection.conn) {
+				t.Error("expected the stream socket")
+			}
+			connected++
+		}
+	}
+}
+
+func TestSeqpacketFallback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("seqpacket unix sockets are linux only")
+	}
+
+	dir := t.TempDir()
+	name := RAND_VALUE + "test_seqpacket_fallback"
+
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	// a seqpacket socket that hangs up on everyone, eg. not a psk-local-ipc server
+	listen, err := net.Listen("unixpacket", filepath.Join(dir, name+".seqpacket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	cc, err := StartClient(name, &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir, Seqpacket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			if _, err := cc.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			break
+		}
+	}
+
+	if conn, _ := cc.connection(); isPacketConn(conn) {
+		t.Error("the client should have fallen back to the stream socket")
+	}
+}
+
+func TestPacketStreamHalfClose(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("seqpacket unix sockets are linux only")
+	}
+
+	path := filepath.Join(t.TempDir(), "half.sock")
+
+	listen, err := net.Listen("unixpacket", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	raw, err := net.Dial("unixpacket", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newPacketStream(raw)
+	defer client.Close()
+
+	serverRaw := <-accepted
+	if serverRaw == nil {
+		t.Fatal("accept failed")
+	}
+	server := newPacketStream(serverRaw)
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte("request"))
+		client.CloseWrite()
+	}()
+
+	request, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request) != "request" {
+		t.Fatalf("unexpected request %q", request)
+	}
+
+	// the other direction is still open
+	if _, err := server.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	server.CloseWrite()
+
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "response" {
+		t.Fatalf("unexpected response %q", response)
+	}
+}
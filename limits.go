@@ -0,0 +1,229 @@
+package ipc
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowAction - what the server does when a connection or rate limit is hit
+type OverflowAction int
+
+const (
+
+	// OverflowReject - 0 - the new Connection or message is dropped
+	OverflowReject OverflowAction = iota
+	// OverflowDelay - 1 - the new Connection or message waits until the limit allows it
+	OverflowDelay OverflowAction = iota
+	// OverflowDisconnect - 2 - the offending Connection is closed
+	OverflowDisconnect OverflowAction = iota
+)
+
+// returns the overflow action as a string
+func (action OverflowAction) String() string {
+	switch action {
+	case OverflowReject:
+		return "reject"
+	case OverflowDelay:
+		return "delay"
+	case OverflowDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// Limit names reported in LimitError
+const (
+	LimitConnections       = "connections"
+	LimitConnectionsPerUID = "connections per uid"
+	LimitMessages          = "messages per second"
+	LimitBytes             = "bytes per second"
+)
+
+// LimitError - returned by Server.Read() when a connection or rate limit has been hit.
+type LimitError struct {
+	Connection *Connection // the Connection that hit the limit
+	Limit      string      // one of the Limit* constants
+	Action     OverflowAction
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit reached - %s", e.Limit, e.Action.String())
+}
+
+// tokenBucket - allows rate tokens per second with bursts of up to burst tokens
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	b := float64(burst)
+	if b < 1 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// wait - returns how long until n tokens are available, n is capped at the burst size
+func (tb *tokenBucket) wait(n float64) time.Duration {
+	if tb == nil {
+		return 0
+	}
+
+	tb.refill(time.Now())
+
+	if n > tb.burst {
+		n = tb.burst
+	}
+	if tb.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((n - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// take - removes n tokens, the bucket may go negative which delays the following messages
+func (tb *tokenBucket) take(n float64) {
+	if tb == nil {
+		return
+	}
+
+	if n > tb.burst {
+		n = tb.burst
+	}
+	tb.tokens -= n
+}
+
+// admitMessage - applies the message and byte rate limits to a recieved frame,
+// returns false if the frame should be dropped.
+func (sc *Server) admitMessage(connection *Connection, size int) bool {
+	wait := connection.msgBucket.wait(1)
+	limit := LimitMessages
+
+	if byteWait := connection.byteBucket.wait(float64(size)); byteWait > wait {
+		wait = byteWait
+		limit = LimitBytes
+	}
+
+	if wait > 0 {
+		atomic.AddUint64(&sc.stats.rateLimited, 1)
+		sc.emit(&Message{err: &LimitError{Connection: connection, Limit: limit, Action: sc.overflowAction}, MsgType: -2})
+
+		switch sc.overflowAction {
+		case OverflowDelay:
+			time.Sleep(wait)
+		case OverflowDisconnect:
+			connection.Close()
+			return false
+		default:
+			return false
+		}
+	}
+
+	connection.msgBucket.take(1)
+	connection.byteBucket.take(float64(size))
+
+	return true
+}
+
+// chargeMessage - takes a control frame from the message and byte rate limits without dropping it,
+// the messages that follow are limited instead
+func (connection *Connection) chargeMessage(size int) {
+	connection.msgBucket.take(1)
+	connection.byteBucket.take(float64(size))
+}
+
+// addConnection - registers a newly accepted Connection, returns a LimitError if the
+// connection limits have been reached and the overflow action isn't delay.
+func (sc *Server) addConnection(connection *Connection) error {
+	uid := -1
+	if connection.peer != nil {
+		uid = connection.peer.UID
+	}
+
+	var deadline <-chan time.Time
+	if sc.handshakeTimeout > 0 {
+		timer := time.NewTimer(sc.handshakeTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		sc.connMutex.Lock()
+
+		limit := ""
+		if sc.maxConnections > 0 && len(sc.connections) >= sc.maxConnections {
+			limit = LimitConnections
+		} else if sc.maxConnectionsPerUID > 0 && uid >= 0 && sc.connectionsPerUID[uid] >= sc.maxConnectionsPerUID {
+			limit = LimitConnectionsPerUID
+		}
+
+		if limit == "" {
+			sc.connections[connection] = struct{}{}
+			if uid >= 0 {
+				sc.connectionsPerUID[uid]++
+			}
+			sc.connMutex.Unlock()
+			return nil
+		}
+
+		changed := sc.connectionsChanged
+		sc.connMutex.Unlock()
+
+		limitErr := &LimitError{Connection: connection, Limit: limit, Action: sc.overflowAction}
+		if sc.overflowAction != OverflowDelay {
+			atomic.AddUint64(&sc.stats.connectionsRejected, 1)
+			return limitErr
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			atomic.AddUint64(&sc.stats.connectionsRejected, 1)
+			return limitErr
+		case <-sc.done:
+			return limitErr
+		}
+	}
+}
+
+// removeConnection - unregisters a Connection, it's safe to call more than once
+func (sc *Server) removeConnection(connection *Connection) {
+	sc.connMutex.Lock()
+	defer sc.connMutex.Unlock()
+
+	if _, ok := sc.connections[connection]; !ok {
+		return
+	}
+
+	delete(sc.connections, connection)
+	if connection.peer != nil && connection.peer.UID >= 0 {
+		sc.connectionsPerUID[connection.peer.UID]--
+		if sc.connectionsPerUID[connection.peer.UID] <= 0 {
+			delete(sc.connectionsPerUID, connection.peer.UID)
+		}
+	}
+
+	close(sc.connectionsChanged)
+	sc.connectionsChanged = make(chan struct{})
+}
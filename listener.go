@@ -0,0 +1,182 @@
+package ipc
+
+import (
+	"errors"
+	"github.com/jc-lab/go-tls-psk"
+	"net"
+)
+
+// Listener - one of the endpoints a Server accepts connections on. Every Server has the listener
+// it was started with, AddListener adds more, eg. a system socket next to a per-user one or an
+// abstract socket next to a socket file. Connections from all of them are read with Server.Read().
+type Listener struct {
+	name       string
+	address    string // the socket the transport listens on, empty if it doesn't say
+	listen     net.Listener
+	tlsConfig  *tls.Config
+	peerPolicy PeerPolicy
+}
+
+// Name - the ipc name the listener was created with
+func (l *Listener) Name() string {
+	return l.name
+}
+
+// Addr - the address the listener is bound to
+func (l *Listener) Addr() net.Addr {
+	return l.listen.Addr()
+}
+
+// AddListener - makes the server accept connections on ipcName as well.
+//
+// The socket is created from the SocketDirectory, Abstract, Transport, Seqpacket, socket permission
+// and directory settings in config, the other settings are the server's. A seqpacket listener
+// comes with a stream one, both are added and the stream one is returned. PskConfig and PeerPolicy
+// default to the server's when they aren't set. Connection.Listener() tells which listener a
+// Connection came from.
+func (sc *Server) AddListener(ipcName string, config *ServerConfig) (*Listener, error) {
+	if config == nil {
+		return nil, errors.New("config is required")
+	}
+
+	err := checkIpcName(ipcName)
+	if err != nil {
+		return nil, err
+	}
+
+	name, abstract, err := splitAbstractName(ipcName, config.Abstract)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := config.Transport
+	if transport == nil {
+		transport = defaultTransport(abstract, config)
+	}
+	transport, packet := splitSeqpacket(transport)
+
+	listen, err := inheritedListener(name, transport)
+	if err == nil && listen == nil {
+		listen, err = transport.Listen(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pskConfig := config.PskConfig
+	if pskConfig.GetKey == nil && pskConfig.GetIdentity == nil {
+		pskConfig = sc.pskConfig
+	}
+
+	peerPolicy := config.PeerPolicy
+	if peerPolicy == nil {
+		peerPolicy = sc.peerPolicy
+	}
+	if _, ok := transport.(AbstractTransport); ok && peerPolicy == nil {
+		peerPolicy = SameUser
+	}
+
+	added := []*Listener{{name: name, address: listenAddress(name, transport), listen: listen, tlsConfig: newServerTLSConfig(pskConfig), peerPolicy: peerPolicy}}
+
+	if packet != nil {
+		l, err := seqpacketListener(name, packet, pskConfig, peerPolicy)
+		if err != nil {
+			listen.Close()
+			return nil, err
+		}
+		if l != nil {
+			added = append(added, l)
+		}
+	}
+
+	sc.emitMutex.Lock()
+	if sc.status == Closed {
+		sc.emitMutex.Unlock()
+		for _, l := range added {
+			l.listen.Close()
+		}
+		return nil, errors.New("the server has been closed")
+	}
+	sc.listeners = append(sc.listeners, added...)
+	running := sc.status == Listening
+	sc.emitMutex.Unlock()
+
+	if running { // otherwise startServer starts them
+		for _, l := range added {
+			go sc.acceptLoop(l)
+		}
+	}
+
+	return added[0], nil
+}
+
+// seqpacketListener - the seqpacket socket a SeqpacketTransport server has next to its stream
+// socket, nil if the os can't create seqpacket sockets, clients then use the stream socket
+func seqpacketListener(name string, transport Transport, pskConfig tls.PSKConfig, peerPolicy PeerPolicy) (*Listener, error) {
+	listen, err := inheritedListener(name, transport)
+	if err == nil && listen == nil {
+		listen, err = transport.Listen(name)
+	}
+	if isSeqpacketUnsupported(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &Listener{name: name, address: listenAddress(name, transport), listen: listen, tlsConfig: newServerTLSConfig(pskConfig), peerPolicy: peerPolicy}, nil
+}
+
+// Listeners - every listener the server accepts on, the one it was started with first
+func (sc *Server) Listeners() []*Listener {
+	sc.emitMutex.RLock()
+	defer sc.emitMutex.RUnlock()
+
+	return append([]*Listener(nil), sc.listeners...)
+}
+
+// Listener - the listener the Connection was accepted on
+func (connection *Connection) Listener() *Listener {
+	return connection.listener
+}
+
+// handoffKey - identifies the listener to the process it's handed to, listeners with the same
+// name in different directories are told apart by their socket path
+func (l *Listener) handoffKey() string {
+	if l.address != "" {
+		return l.address
+	}
+	return l.name
+}
+
+// listenAddress - the socket the transport listens on for name, empty if it doesn't say
+func listenAddress(name string, transport Transport) string {
+	if addresser, ok := transport.(listenAddresser); ok {
+		return addresser.listenAddress(name)
+	}
+	return ""
+}
+
+// secure - the tls layer for a connection accepted on this listener, seqpacket sockets carry it in packets
+func (l *Listener) secure(conn net.Conn) *tls.Conn {
+	if isPacketConn(conn) {
+		conn = newPacketStream(conn)
+	}
+	return tls.Server(conn, l.tlsConfig)
+}
+
+// newServerTLSConfig - the tls settings every listener uses, with its own psk
+func newServerTLSConfig(pskConfig tls.PSKConfig) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS10,
+		MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_PSK_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_PSK_WITH_AES_256_CBC_SHA384,
+			tls.TLS_ECDHE_PSK_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA,
+		},
+		InsecureSkipVerify: true,
+		Extra:              pskConfig,
+		Certificates:       []tls.Certificate{tls.Certificate{}},
+	}
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile - takes an exclusive lock on f without waiting, it's released when f is closed
+func lockFile(f *os.File) error {
+	var overlapped windows.Overlapped
+
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return ErrInstanceLocked
+	}
+
+	return err
+}
@@ -0,0 +1,239 @@
+package ipc
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LockoutPolicy - locks a peer out after repeated failed psk handshakes.
+//
+// Every connection that fails the tls psk handshake counts as a failure, whatever the reason (a
+// wrong key or identity, or not speaking tls at all), only peers that hang up before it are let
+// off. After MaxFailures failures the peer is refused for BaseDelay, the delay doubles with every
+// further failure up to MaxDelay.
+//
+// Peers are identified by uid, or by pid if KeyByPID is set. Keyed by uid, any process running as
+// the same user as the legitimate clients can get them locked out by failing on purpose, use it
+// where the clients run as a different user to the processes that shouldn't connect. Keyed by pid
+// a peer only locks itself out, but a new process gets a fresh count.
+type LockoutPolicy struct {
+	MaxFailures int           // failures allowed before the first lockout, defaults to 3
+	BaseDelay   time.Duration // length of the first lockout, defaults to 1 second
+	MaxDelay    time.Duration // longest lockout, defaults to 5 minutes
+	ResetAfter  time.Duration // failures are forgotten after this long without another failure, defaults to 15 minutes
+	KeyByPID    bool
+}
+
+// AuditEventType - the kind of event passed to ServerConfig.AuditHook
+type AuditEventType int
+
+const (
+
+	// AuditHandshakeFailed - 0 - a peer failed the tls psk handshake
+	AuditHandshakeFailed AuditEventType = iota
+	// AuditLockedOut - 1 - a peer has just been locked out
+	AuditLockedOut AuditEventType = iota
+	// AuditLockoutRejected - 2 - a Connection from a locked out peer was refused
+	AuditLockoutRejected AuditEventType = iota
+)
+
+// returns the audit event type as a string
+func (t AuditEventType) String() string {
+	switch t {
+	case AuditHandshakeFailed:
+		return "handshake failed"
+	case AuditLockedOut:
+		return "locked out"
+	case AuditLockoutRejected:
+		return "lockout rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// AuditEvent - passed to ServerConfig.AuditHook
+type AuditEvent struct {
+	Time        time.Time
+	Type        AuditEventType
+	Peer        *PeerCredentials // nil if the os doesn't report peer credentials
+	Failures    int              // consecutive failures recorded for the peer
+	LockedUntil time.Time        // zero unless the peer is locked out
+	Err         error            // the handshake error, if any
+}
+
+// ErrLockedOut - reported through Server.Read() when a locked out peer tries to connect
+var ErrLockedOut = errors.New("peer is locked out after too many failed handshakes")
+
+type lockoutRecord struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// lockoutTracker - failed handshake records keyed by peer uid or pid
+type lockoutTracker struct {
+	policy  LockoutPolicy
+	mutex   sync.Mutex
+	records map[int]*lockoutRecord
+}
+
+func newLockoutTracker(policy *LockoutPolicy) *lockoutTracker {
+	if policy == nil {
+		return nil
+	}
+
+	lt := &lockoutTracker{policy: *policy, records: make(map[int]*lockoutRecord)}
+
+	if lt.policy.MaxFailures < 1 {
+		lt.policy.MaxFailures = lockoutMaxFailures
+	}
+	if lt.policy.BaseDelay <= 0 {
+		lt.policy.BaseDelay = lockoutBaseDelay
+	}
+	if lt.policy.MaxDelay <= 0 {
+		lt.policy.MaxDelay = lockoutMaxDelay
+	}
+	if lt.policy.ResetAfter <= 0 {
+		lt.policy.ResetAfter = lockoutResetAfter
+	}
+
+	return lt
+}
+
+func (lt *lockoutTracker) key(peer *PeerCredentials) (int, bool) {
+	if lt == nil || peer == nil {
+		return 0, false
+	}
+	if lt.policy.KeyByPID {
+		return peer.PID, true
+	}
+	return peer.UID, true
+}
+
+// lockedUntil - returns the end of the peer's lockout, zero if it isn't locked out
+func (lt *lockoutTracker) lockedUntil(peer *PeerCredentials) (time.Time, int) {
+	key, ok := lt.key(peer)
+	if !ok {
+		return time.Time{}, 0
+	}
+
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	record := lt.records[key]
+	if record == nil || !time.Now().Before(record.lockedUntil) {
+		return time.Time{}, 0
+	}
+
+	return record.lockedUntil, record.failures
+}
+
+// failure - records a failed handshake, returns the failure count and the lockout end (zero if not locked out)
+func (lt *lockoutTracker) failure(peer *PeerCredentials) (int, time.Time) {
+	key, ok := lt.key(peer)
+	if !ok {
+		return 0, time.Time{}
+	}
+
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	now := time.Now()
+
+	record := lt.records[key]
+	if record == nil || now.Sub(record.lastFailure) > lt.policy.ResetAfter {
+		record = &lockoutRecord{}
+		lt.records[key] = record
+	}
+
+	record.failures++
+	record.lastFailure = now
+
+	if record.failures < lt.policy.MaxFailures {
+		return record.failures, time.Time{}
+	}
+
+	delay := lt.policy.BaseDelay
+	for i := lt.policy.MaxFailures; i < record.failures && delay < lt.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > lt.policy.MaxDelay {
+		delay = lt.policy.MaxDelay
+	}
+
+	record.lockedUntil = now.Add(delay)
+
+	return record.failures, record.lockedUntil
+}
+
+// success - forgets the peer's failures
+func (lt *lockoutTracker) success(peer *PeerCredentials) {
+	key, ok := lt.key(peer)
+	if !ok {
+		return
+	}
+
+	lt.mutex.Lock()
+	delete(lt.records, key)
+	lt.mutex.Unlock()
+}
+
+// lockedOut - returns the number of peers currently locked out
+func (lt *lockoutTracker) lockedOut() int {
+	if lt == nil {
+		return 0
+	}
+
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	now := time.Now()
+	count := 0
+	for key, record := range lt.records {
+		if now.Before(record.lockedUntil) {
+			count++
+		} else if now.Sub(record.lastFailure) > lt.policy.ResetAfter {
+			delete(lt.records, key)
+		}
+	}
+
+	return count
+}
+
+// audit - passes an event to the audit hook, if there is one
+func (sc *Server) audit(event AuditEvent) {
+	if sc.auditHook == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	sc.auditHook(event)
+}
+
+// checkLockout - refuses peers that are locked out
+func (sc *Server) checkLockout(peer *PeerCredentials) error {
+	until, failures := sc.lockout.lockedUntil(peer)
+	if until.IsZero() {
+		return nil
+	}
+
+	atomic.AddUint64(&sc.stats.lockoutRejections, 1)
+	sc.audit(AuditEvent{Type: AuditLockoutRejected, Peer: peer, Failures: failures, LockedUntil: until})
+
+	return ErrLockedOut
+}
+
+// handshakeFailed - records a failed tls psk handshake against the peer
+func (sc *Server) handshakeFailed(peer *PeerCredentials, err error) {
+	atomic.AddUint64(&sc.stats.authFailures, 1)
+
+	failures, until := sc.lockout.failure(peer)
+
+	sc.audit(AuditEvent{Type: AuditHandshakeFailed, Peer: peer, Failures: failures, Err: err})
+
+	if !until.IsZero() {
+		sc.audit(AuditEvent{Type: AuditLockedOut, Peer: peer, Failures: failures, LockedUntil: until})
+	}
+}
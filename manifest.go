@@ -0,0 +1,178 @@
+package ipc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Manifest - describes a running server. It's written next to the socket as <name>.json when
+// ServerConfig.Manifest is set (unix socket files only) and returned by Discover.
+type Manifest struct {
+	Marker          string    `json:"psk_local_ipc"` // always manifestMarker, tells manifests apart from other json files
+	Name            string    `json:"name"`
+	Socket          string    `json:"socket"`
+	PID             int       `json:"pid"`
+	UID             int       `json:"uid"`
+	StartTime       time.Time `json:"start_time"`
+	AppName         string    `json:"app_name,omitempty"`
+	AppVersion      string    `json:"app_version,omitempty"`
+	ProtocolVersion int       `json:"protocol_version"`
+	Capabilities    []string  `json:"capabilities"`
+}
+
+// capabilities a server can list in its manifest
+const (
+	CapabilityFiles        = "files"         // SendFiles
+	CapabilitySharedMemory = "shared-memory" // SharedMemorySize is set
+)
+
+// writeManifest - writes the manifest for the server's socket file, if it has one
+func (sc *Server) writeManifest(config *ServerConfig) error {
+	addresser, ok := sc.transport.(listenAddresser)
+	if !ok {
+		return nil
+	}
+
+	socket := addresser.listenAddress(sc.name)
+	if strings.HasPrefix(socket, "@") {
+		return nil
+	}
+
+	manifest := Manifest{
+		Marker:          manifestMarker,
+		Name:            sc.name,
+		Socket:          socket,
+		PID:             os.Getpid(),
+		UID:             os.Geteuid(),
+		StartTime:       time.Now().UTC(),
+		AppName:         config.AppName,
+		AppVersion:      config.AppVersion,
+		ProtocolVersion: version,
+		Capabilities:    []string{},
+	}
+
+	if runtime.GOOS != "windows" {
+		manifest.Capabilities = append(manifest.Capabilities, CapabilityFiles)
+	}
+	if runtime.GOOS == "linux" && sc.sharedMemorySize > 0 {
+		manifest.Capabilities = append(manifest.Capabilities, CapabilitySharedMemory)
+	}
+
+	data, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := strings.TrimSuffix(socket, ".sock") + ".json"
+
+	// written to a temporary file first so Discover never sees half a manifest
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".manifest-")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Chmod(0644)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	sc.manifestPath = path
+	sc.manifestStart = manifest.StartTime
+
+	return nil
+}
+
+// removeManifest - removes the manifest written by writeManifest, unless another server has replaced it
+func (sc *Server) removeManifest() {
+	if sc.manifestPath == "" {
+		return
+	}
+
+	manifest, err := readManifest(sc.manifestPath)
+	if err == nil && manifest.PID == os.Getpid() && manifest.StartTime.Equal(sc.manifestStart) {
+		os.Remove(sc.manifestPath)
+	}
+}
+
+// Discover - lists the servers with a manifest in directory (/tmp/ if empty). Every socket is
+// probed, manifests left behind by servers that have gone are removed. Manifests naming a socket
+// outside directory, or one that isn't owned by this user, are ignored.
+func Discover(directory string) ([]Manifest, error) {
+	if directory == "" {
+		directory = "/tmp/"
+	}
+
+	paths, err := filepath.Glob(filepath.Join(directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := []Manifest{}
+
+	for _, path := range paths {
+		manifest, err := readManifest(path)
+		if err != nil {
+			continue // not one of ours
+		}
+
+		if !inDirectory(manifest.Socket, directory) {
+			continue // anyone who can write the directory could point clients elsewhere
+		}
+
+		live, stale := probeSocket(manifest.Socket)
+		if live {
+			manifests = append(manifests, *manifest)
+		} else if stale {
+			os.Remove(path)
+		}
+	}
+
+	return manifests, nil
+}
+
+// inDirectory - reports whether path names a file directly inside directory
+func inDirectory(path string, directory string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	directory, err = filepath.Abs(directory)
+	if err != nil {
+		return false
+	}
+
+	return filepath.Dir(path) == directory
+}
+
+func readManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+
+	if manifest.Marker != manifestMarker {
+		return nil, os.ErrNotExist
+	}
+
+	return &manifest, nil
+}
@@ -0,0 +1,70 @@
+package ipc
+
+import (
+	"errors"
+	"net"
+)
+
+// packetStream - carries tls over a seqpacket socket. Every write is a packet of at most
+// maxPacketPayload bytes, and a read takes in the whole of the next packet so none is cut short
+// by tls asking for less than a packet holds. tls serialises its own reads and writes.
+type packetStream struct {
+	net.Conn
+	packet  []byte // buffer for the packet being read
+	pending []byte // data from it not read yet
+}
+
+// isPacketConn - reports whether conn is a seqpacket socket, possibly wrapped
+func isPacketConn(conn net.Conn) bool {
+	return conn.LocalAddr() != nil && conn.LocalAddr().Network() == "unixpacket"
+}
+
+// newPacketStream - conn is the seqpacket socket, wrapped for file passing if it can
+func newPacketStream(conn net.Conn) *packetStream {
+	return &packetStream{Conn: conn, packet: make([]byte, maxPacketPayload)}
+}
+
+// Write - sends b as packets of up to maxPacketPayload bytes
+func (c *packetStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > maxPacketPayload {
+			chunk = chunk[:maxPacketPayload]
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Read - returns data from the next packet, whatever doesn't fit in b is kept for the next Read
+func (c *packetStream) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		n, err := c.Conn.Read(c.packet)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = c.packet[:n]
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// CloseWrite - half closes the socket, the peer reads EOF once it has every packet sent so far
+func (c *packetStream) CloseWrite() error {
+	closer, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.New("the connection can't be half closed")
+	}
+
+	return closer.CloseWrite()
+}
@@ -0,0 +1,126 @@
+package ipc
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/jc-lab/go-tls-psk"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDF - key derivation function used to turn a passphrase into a PSK
+type KDF int
+
+const (
+
+	// Scrypt - 0
+	Scrypt KDF = iota
+	// Argon2id - 1
+	Argon2id KDF = iota
+)
+
+// PassphraseConfig - used to pass the salt and cost parameters to DerivePSKConfig()
+//
+// Zero cost parameters are replaced by the defaults (scrypt N=32768 r=8 p=1, argon2id time=1 memory=64MiB threads=4).
+// Both sides of the connection must use exactly the same values.
+type PassphraseConfig struct {
+	KDF           KDF
+	Identity      string // psk identity sent by the client - defaults to the ipc name
+	Salt          []byte
+	ScryptN       int
+	ScryptR       int
+	ScryptP       int
+	Argon2Time    uint32
+	Argon2Memory  uint32 // in KiB
+	Argon2Threads uint8
+}
+
+// DerivePSKConfig - derives a PSKConfig from a human passphrase.
+//
+// ipcName = the name of the socket/pipe the key will be used with, it is mixed into the salt
+// so the same passphrase gives a different key for every ipc name.
+//
+// The key is derived once, up front, as the KDFs are deliberately slow.
+func DerivePSKConfig(ipcName string, passphrase []byte, config *PassphraseConfig) (tls.PSKConfig, error) {
+	if config == nil {
+		return tls.PSKConfig{}, errors.New("config is required")
+	}
+
+	err := checkIpcName(ipcName)
+	if err != nil {
+		return tls.PSKConfig{}, err
+	}
+
+	if len(passphrase) == 0 {
+		return tls.PSKConfig{}, errors.New("passphrase cannot be empty")
+	}
+
+	if len(config.Salt) == 0 {
+		return tls.PSKConfig{}, errors.New("salt is required")
+	}
+
+	salt := bindSalt(ipcName, config.Salt)
+
+	var key []byte
+
+	switch config.KDF {
+	case Scrypt:
+		n, r, p := config.ScryptN, config.ScryptR, config.ScryptP
+		if n == 0 {
+			n = scryptN
+		}
+		if r == 0 {
+			r = scryptR
+		}
+		if p == 0 {
+			p = scryptP
+		}
+
+		key, err = scrypt.Key(passphrase, salt, n, r, p, derivedKeySize)
+		if err != nil {
+			return tls.PSKConfig{}, err
+		}
+	case Argon2id:
+		t, m, th := config.Argon2Time, config.Argon2Memory, config.Argon2Threads
+		if t == 0 {
+			t = argon2Time
+		}
+		if m == 0 {
+			m = argon2Memory
+		}
+		if th == 0 {
+			th = argon2Threads
+		}
+
+		key = argon2.IDKey(passphrase, salt, t, m, th, derivedKeySize)
+	default:
+		return tls.PSKConfig{}, errors.New("unknown key derivation function")
+	}
+
+	identity := config.Identity
+	if identity == "" {
+		identity = ipcName
+	}
+
+	return tls.PSKConfig{
+		GetIdentity: func() string {
+			return identity
+		},
+		GetKey: func(id string) ([]byte, error) {
+			if subtle.ConstantTimeCompare([]byte(id), []byte(identity)) != 1 {
+				return nil, errors.New("INVALID IDENTITY: " + id)
+			}
+			return key, nil
+		},
+	}, nil
+}
+
+// prefixes the user salt with a domain separator and the length prefixed ipc name
+func bindSalt(ipcName string, salt []byte) []byte {
+	b := make([]byte, 0, len(saltDomain)+4+len(ipcName)+len(salt))
+	b = append(b, saltDomain...)
+	b = append(b, intToBytes(len(ipcName))...)
+	b = append(b, ipcName...)
+	b = append(b, salt...)
+	return b
+}
@@ -0,0 +1,47 @@
+//go:build darwin
+// +build darwin
+
+package ipc
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials - reads LOCAL_PEERCRED and LOCAL_PEERPID from the unix socket underneath conn
+func peerCredentials(conn net.Conn) (*PeerCredentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("peer credentials are only available for unix sockets")
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var xucred *unix.Xucred
+	var pid int
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		xucred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		if credErr == nil {
+			pid, credErr = unix.GetsockoptInt(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	cred := &PeerCredentials{PID: pid, UID: int(xucred.Uid), GID: -1}
+	if xucred.Ngroups > 0 {
+		cred.GID = int(xucred.Groups[0])
+	}
+
+	return cred, nil
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials - named pipes don't carry unix style credentials
+func peerCredentials(conn net.Conn) (*PeerCredentials, error) {
+	return nil, errors.New("peer credentials are not supported on windows")
+}
@@ -0,0 +1,42 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// PeerPolicy - decides whether the process on the other end of a Connection is allowed to connect.
+// peer is nil when the os doesn't report peer credentials.
+type PeerPolicy func(peer *PeerCredentials) error
+
+// SameUser - PeerPolicy that only allows processes running with the same uid as this one.
+// It's the default for abstract sockets as they have no file permissions.
+func SameUser(peer *PeerCredentials) error {
+	if peer == nil {
+		return errors.New("peer credentials are not available")
+	}
+
+	if peer.UID != os.Getuid() {
+		return fmt.Errorf("peer uid %d is not allowed", peer.UID)
+	}
+
+	return nil
+}
+
+// AllowUIDs - returns a PeerPolicy that only allows processes running as one of uids
+func AllowUIDs(uids ...int) PeerPolicy {
+	return func(peer *PeerCredentials) error {
+		if peer == nil {
+			return errors.New("peer credentials are not available")
+		}
+
+		for _, uid := range uids {
+			if peer.UID == uid {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("peer uid %d is not allowed", peer.UID)
+	}
+}
@@ -3,8 +3,11 @@ package ipc
 import (
 	"bufio"
 	"errors"
-	"github.com/jc-lab/go-tls-psk"
+	"io"
+	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,14 +26,108 @@ func StartServer(ipcName string, config *ServerConfig) (*Server, error) {
 		return nil, err
 	}
 
+	name, abstract, err := splitAbstractName(ipcName, config.Abstract)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := newServer(name, abstract, config)
+
+	// a seqpacket server's main listener is the stream socket, every client can use it
+	var packet Transport
+	sc.transport, packet = splitSeqpacket(sc.transport)
+
+	listen, err := inheritedListener(sc.name, sc.transport)
+	if err == nil && listen == nil {
+		listen, err = sc.createListenSocket()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sc.listeners = []*Listener{{name: sc.name, address: listenAddress(sc.name, sc.transport), listen: listen, tlsConfig: newServerTLSConfig(sc.pskConfig), peerPolicy: sc.peerPolicy}}
+
+	if packet != nil {
+		l, err := seqpacketListener(sc.name, packet, sc.pskConfig, sc.peerPolicy)
+		if err != nil {
+			listen.Close()
+			return nil, err
+		}
+		if l != nil {
+			sc.listeners = append(sc.listeners, l)
+		}
+	}
+
+	if config.Manifest {
+		if err := sc.writeManifest(config); err != nil {
+			for _, l := range sc.listeners {
+				l.listen.Close()
+			}
+			return nil, err
+		}
+	}
+
+	go startServer(sc)
+
+	return sc, nil
+}
+
+// ServeListener - starts the ipc server on a listener created elsewhere, eg. inherited from a parent
+// process or handed over by a sandbox broker. The tls psk layer and the ipc handshake are applied to
+// every accepted Connection, the Transport and socket settings in config are ignored.
+func ServeListener(listen net.Listener, config *ServerConfig) (*Server, error) {
+	if config == nil {
+		return nil, errors.New("config is required")
+	}
+
+	if listen == nil {
+		return nil, errors.New("listener is required")
+	}
+
+	sc := newServer(listen.Addr().String(), false, config)
+
+	sc.listeners = []*Listener{{name: sc.name, listen: listen, tlsConfig: newServerTLSConfig(sc.pskConfig), peerPolicy: sc.peerPolicy}}
+
+	go startServer(sc)
+
+	return sc, nil
+}
+
+func newServer(name string, abstract bool, config *ServerConfig) *Server {
 	sc := &Server{
-		name:               ipcName,
-		status:             NotConnected,
-		recieved:           make(chan *Message),
-		unMask:             -1,
-		pskConfig:          config.PskConfig,
-		socketDirectory:    config.SocketDirectory,
-		securityDescriptor: config.SecurityDescriptor,
+		name:            name,
+		abstract:        abstract,
+		peerPolicy:      config.PeerPolicy,
+		status:          NotConnected,
+		recieved:        make(chan *Message),
+		done:            make(chan struct{}),
+		pskConfig:       config.PskConfig,
+		socketDirectory: config.SocketDirectory,
+		transport:       config.Transport,
+		stats:           &serverStats{},
+
+		maxConnections:       config.MaxConnections,
+		maxConnectionsPerUID: config.MaxConnectionsPerUID,
+		overflowAction:       config.OverflowAction,
+		messageRate:          config.MessageRateLimit,
+		messageBurst:         config.MessageBurst,
+		byteRate:             config.ByteRateLimit,
+		byteBurst:            config.ByteBurst,
+		connections:          make(map[*Connection]struct{}),
+		connectionsPerUID:    make(map[int]int),
+		connectionsChanged:   make(chan struct{}),
+		lockout:              newLockoutTracker(config.Lockout),
+		auditHook:            config.AuditHook,
+
+		sharedMemorySize:      config.SharedMemorySize,
+		sharedMemoryThreshold: config.SharedMemoryThreshold,
+
+		drainTimeout:  config.DrainTimeout,
+		releaseStderr: config.ReleaseStderr,
+	}
+
+	if sc.drainTimeout <= 0 {
+		sc.drainTimeout = drainTimeout
 	}
 
 	if config.MaxMsgSize < 1024 {
@@ -39,85 +136,214 @@ func StartServer(ipcName string, config *ServerConfig) (*Server, error) {
 		sc.maxMsgSize = config.MaxMsgSize
 	}
 
-	if config.UseUnmask {
-		sc.unMask = config.Unmask
+	if sc.transport == nil {
+		sc.transport = defaultTransport(sc.abstract, config)
 	}
 
-	go startServer(sc)
+	if _, ok := sc.transport.(AbstractTransport); ok && sc.peerPolicy == nil {
+		sc.peerPolicy = SameUser
+	}
+
+	if config.HandshakeTimeout == 0 {
+		sc.handshakeTimeout = handshakeTimeout
+	} else if config.HandshakeTimeout > 0 {
+		sc.handshakeTimeout = config.HandshakeTimeout
+	}
+
+	if config.MaxPendingHandshakes < 1 {
+		sc.handshakeSlots = make(chan struct{}, maxPendingHandshakes)
+	} else {
+		sc.handshakeSlots = make(chan struct{}, config.MaxPendingHandshakes)
+	}
 
-	return sc, err
+	return sc
 }
 
 func startServer(sc *Server) {
-	listen, err := sc.createListenSocket()
-	if err != nil {
-		sc.recieved <- &Message{err: err, MsgType: -2}
+	sc.emitMutex.Lock()
+	if sc.status == Closed { // Close() was called before we got here
+		sc.emitMutex.Unlock()
 		return
 	}
-
-	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS10,
-		MaxVersion: tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_PSK_WITH_CHACHA20_POLY1305_SHA256,
-			tls.TLS_ECDHE_PSK_WITH_AES_256_CBC_SHA384,
-			tls.TLS_ECDHE_PSK_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA,
-		},
-		InsecureSkipVerify: true,
-		Extra:              sc.pskConfig,
-		Certificates:       []tls.Certificate{tls.Certificate{}},
-	}
-	sc.listen = tls.NewListener(listen, tlsConfig)
 	sc.status = Listening
+	listeners := append([]*Listener(nil), sc.listeners...) // AddListener starts the ones added from now on
+	sc.emitMutex.Unlock()
+
+	stderrErr := releaseAutoStartStderr(sc.releaseStderr) // before accepting, the client stops reading once it connects
 
-	go sc.acceptLoop()
+	for _, l := range listeners {
+		go sc.acceptLoop(l)
+	}
 
-	sc.recieved <- &Message{Status: sc.status, MsgType: -1}
+	if stderrErr != nil {
+		sc.emit(&Message{err: errors.New("unable to release the auto-start stderr: " + stderrErr.Error()), MsgType: -2})
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		sc.emit(&Message{err: errors.New("unable to notify systemd: " + err.Error()), MsgType: -2})
+	}
+
+	sc.emit(&Message{Status: Listening, MsgType: -1})
 }
 
-func (sc *Server) acceptLoop() {
+// inheritedListener - returns the listening socket systemd, or Handoff in the previous process,
+// passed for name, nil if there isn't one
+func inheritedListener(name string, transport Transport) (net.Listener, error) {
+	address := listenAddress(name, transport)
+
+	listen, err := activationListener(name, address)
+	if err != nil || listen != nil {
+		return listen, err
+	}
+
+	return handoffListener(name, address)
+}
+
+// acceptLoop only accepts, each Connection is handshaked on its own go routine so a
+// stalled client can't hold up everyone else.
+func (sc *Server) acceptLoop(l *Listener) {
 	for {
-		conn, err := sc.listen.Accept()
+		conn, err := l.listen.Accept()
 		if err != nil {
 			break
 		}
 
-		connection := &Connection{
-			maxMsgSize: sc.maxMsgSize,
-			conn:       conn,
-			status:     Connecting,
-			toWrite:    make(chan *Message),
-			mutex:      &sync.Mutex{},
+		select {
+		case sc.handshakeSlots <- struct{}{}:
+			atomic.AddUint64(&sc.stats.handshakesInProgress, 1)
+			go sc.accept(l, conn)
+		default:
+			atomic.AddUint64(&sc.stats.handshakesDropped, 1)
+			conn.Close()
+			sc.emit(&Message{err: errors.New("handshake dropped - too many handshakes in progress"), MsgType: -2})
 		}
+	}
+
+}
 
-		sc.recieved <- &Message{
+func (sc *Server) accept(l *Listener, conn net.Conn) {
+	defer func() {
+		atomic.AddUint64(&sc.stats.handshakesInProgress, ^uint64(0))
+		<-sc.handshakeSlots
+	}()
+
+	peer, _ := peerCredentials(conn)
+
+	conn = wrapFileConn(conn)
+	secure := l.secure(conn)
+
+	connection := &Connection{
+		maxMsgSize: sc.maxMsgSize,
+		conn:       secure,
+		status:     Connecting,
+		toWrite:    make(chan *Message),
+		mutex:      &sync.Mutex{},
+		msgBucket:  newTokenBucket(sc.messageRate, sc.messageBurst),
+		byteBucket: newTokenBucket(sc.byteRate, sc.byteBurst),
+		listener:   l,
+	}
+
+	connection.peer = peer
+	connection.files, _ = conn.(fileConn)
+
+	if err := sc.checkLockout(connection.peer); err != nil {
+		sc.emit(&Message{err: err, MsgType: -2})
+		conn.Close()
+		return
+	}
+
+	if l.peerPolicy != nil {
+		if err := l.peerPolicy(connection.peer); err != nil {
+			sc.emit(&Message{err: err, MsgType: -2})
+			conn.Close()
+			return
+		}
+	}
+
+	if err := sc.addConnection(connection); err != nil {
+		sc.emit(&Message{err: err, MsgType: -2})
+		conn.Close()
+		return
+	}
+
+	if sc.handshakeTimeout > 0 {
+		secure.SetDeadline(time.Now().Add(sc.handshakeTimeout))
+	}
+
+	err := secure.Handshake()
+	if err != nil && isConnectionDropped(err) {
+		// the peer went away before the secure handshake, eg. a liveness probe that connects and closes,
+		// it isn't reported at all
+		sc.removeConnection(connection)
+		conn.Close()
+		return
+	}
+	if err != nil {
+		sc.handshakeFailed(connection.peer, err)
+	}
+	if err == nil {
+		// the Connection is announced once the peer has the psk, the deadline restarts afterwards
+		// so a slow Read() doesn't time out the ipc handshake
+		secure.SetDeadline(time.Time{})
+
+		sc.emit(&Message{
 			MsgType:    -2,
 			Connection: connection,
 			Status:     connection.status,
+		})
+
+		if sc.handshakeTimeout > 0 {
+			secure.SetDeadline(time.Now().Add(sc.handshakeTimeout))
 		}
 
-		err2 := sc.handshake(connection)
-		if err2 != nil {
-			sc.recieved <- &Message{err: err2, MsgType: -2}
-			conn.Close()
+		err = sc.handshake(connection)
+	}
+	if err != nil {
+		if isTimeout(err) {
+			atomic.AddUint64(&sc.stats.handshakesTimedOut, 1)
 		} else {
-			go sc.read(connection)
-			go sc.write(connection)
+			atomic.AddUint64(&sc.stats.handshakesFailed, 1)
+		}
+		sc.removeConnection(connection)
+		sc.emit(&Message{err: err, MsgType: -2})
+		conn.Close()
+		return
+	}
 
-			connection.status = Connected
+	secure.SetDeadline(time.Time{})
 
-			sc.recieved <- &Message{
-				MsgType:    -2,
-				Connection: connection,
-				Status:     connection.status,
-			}
-		}
+	sc.lockout.success(connection.peer)
+
+	connection.shm = newSharedMemory(secure, connection.files, sc.sharedMemorySize, sc.sharedMemoryThreshold)
+
+	go sc.read(connection)
+	go sc.write(connection)
+
+	connection.mutex.Lock()
+	connection.status = Connected
+	connection.mutex.Unlock()
+
+	connection.offerSharedMemory()
+
+	sc.connMutex.Lock()
+	handingOff := sc.handingOff
+	sc.connMutex.Unlock()
+
+	if handingOff { // Handoff ran while the Connection was handshaking
+		connection.goodbye()
 	}
 
+	// not connection.status, read() may already have closed it
+	sc.emit(&Message{
+		MsgType:    -2,
+		Connection: connection,
+		Status:     Connected,
+	})
 }
 
 func (sc *Server) read(connection *Connection) {
+	defer connection.shm.close()
+
 	bLen := make([]byte, 4)
 
 	for {
@@ -137,25 +363,32 @@ func (sc *Server) read(connection *Connection) {
 		}
 
 		if bytesToInt(msgRecvd[:4]) == 0 {
-			//  type 0 = control message
-		} else {
-			if sc.Status() != Closed {
-				sc.recieved <- &Message{Connection: connection, Data: msgRecvd[4:], MsgType: bytesToInt(msgRecvd[:4])}
-			}
+			//  type 0 = control message, it's never dropped by the limits - the file descriptors
+			// queued with it have to be taken in order. control limits any message it carries.
+			sc.control(connection, msgRecvd[4:])
+			continue
 		}
+
+		if !sc.admitMessage(connection, mLen) {
+			continue
+		}
+
+		sc.emit(&Message{Connection: connection, Data: msgRecvd[4:], MsgType: bytesToInt(msgRecvd[:4])})
 	}
 }
 
 func (sc *Server) readData(connection *Connection, buff []byte) bool {
-	_, err := connection.conn.Read(buff)
+	_, err := io.ReadFull(connection.conn, buff)
 	if err != nil {
 
+		connection.mutex.Lock() // goodbye() and sendControl() check the status under it
 		oldStatus := connection.status
 		connection.status = Closed
+		connection.mutex.Unlock()
 
-		if sc.Status() != Closed {
-			sc.recieved <- &Message{Connection: connection, Status: connection.status, MsgType: -1}
-		}
+		sc.removeConnection(connection)
+
+		sc.emit(&Message{Connection: connection, Status: connection.status, MsgType: -1})
 
 		if oldStatus == Closing {
 			return false
@@ -203,7 +436,12 @@ func (connection *Connection) Write(msgType int, message []byte) error {
 
 	connection.mutex.Lock()
 	if connection.status == Connected {
-		connection.toWrite <- &Message{MsgType: msgType, Data: message}
+		sent := connection.shm.write(msgType, message, func(frame []byte) {
+			connection.toWrite <- &Message{MsgType: 0, Data: frame}
+		})
+		if !sent {
+			connection.toWrite <- &Message{MsgType: msgType, Data: message}
+		}
 		connection.mutex.Unlock()
 	} else {
 		connection.mutex.Unlock()
@@ -224,6 +462,10 @@ func (sc *Server) write(connection *Connection) {
 			break
 		}
 
+		if len(m.Files) > 0 {
+			connection.files.queueFiles(m.Files)
+		}
+
 		toSend := intToBytes(m.MsgType)
 
 		writer := bufio.NewWriter(connection.conn)
@@ -243,20 +485,204 @@ func (sc *Server) write(connection *Connection) {
 	}
 }
 
+// control - handles a type 0 control message
+func (sc *Server) control(connection *Connection, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	if data[0] != controlFiles && data[0] != controlShmData {
+		connection.chargeMessage(len(data))
+	}
+
+	switch data[0] {
+	case controlFiles:
+		msgType, message, files, err := decodeFilesFrame(connection.conn, connection.files, data)
+		if err != nil {
+			sc.emit(&Message{err: err, MsgType: -2})
+			connection.Close()
+			return
+		}
+
+		if msgType == 0 { // a control message carrying files
+			if reply := connection.shm.acceptOffer(message, files); reply != nil {
+				go connection.sendControl(reply, nil)
+			}
+			return
+		}
+
+		if !sc.admitMessage(connection, len(data)) { // the files have been taken, so it can be dropped
+			closeFiles(files)
+			return
+		}
+
+		sc.emit(&Message{Connection: connection, Data: message, MsgType: msgType, Files: files})
+
+	case controlShmAccept:
+		connection.shm.peerAccepted()
+
+	case controlShmData:
+		msgType, message, release, err := connection.shm.read(data)
+		if err != nil {
+			sc.emit(&Message{err: err, MsgType: -2})
+			connection.Close()
+			return
+		}
+
+		go connection.sendControl(release, nil)
+
+		if !sc.admitMessage(connection, len(data)+len(message)) { // released, so it can be dropped
+			return
+		}
+
+		sc.emit(&Message{Connection: connection, Data: message, MsgType: msgType})
+
+	case controlShmRelease:
+		connection.shm.release(data)
+	}
+}
+
+// offerSharedMemory - hands this side's shared memory ring to the client
+func (connection *Connection) offerSharedMemory() {
+	if connection.shm == nil {
+		return
+	}
+
+	frame, files, err := connection.shm.offer(connection.conn)
+	if err != nil {
+		return
+	}
+
+	connection.sendControl(frame, files)
+}
+
+// sendControl - queues a control message, it's dropped if the Connection has gone
+func (connection *Connection) sendControl(frame []byte, files []*os.File) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+
+	if connection.status != Connected {
+		closeFiles(files)
+		return
+	}
+
+	connection.toWrite <- &Message{MsgType: 0, Data: frame, Files: files}
+}
+
+// emit - passes a message to Read(), messages are discarded once the server has been closed.
+func (sc *Server) emit(m *Message) {
+	sc.emitMutex.RLock()
+	defer sc.emitMutex.RUnlock()
+
+	if sc.status == Closed {
+		return
+	}
+
+	select {
+	case sc.recieved <- m:
+	case <-sc.done:
+	}
+}
+
 // Status - returns the current Connection status as a string
 func (sc *Server) Status() Status {
+	sc.emitMutex.RLock()
+	defer sc.emitMutex.RUnlock()
+
 	return sc.status
 }
 
+// Stats - returns a snapshot of the server counters
+func (sc *Server) Stats() ServerStats {
+	sc.connMutex.Lock()
+	connections := len(sc.connections)
+	sc.connMutex.Unlock()
+
+	return ServerStats{
+		HandshakesInProgress: atomic.LoadUint64(&sc.stats.handshakesInProgress),
+		HandshakesDropped:    atomic.LoadUint64(&sc.stats.handshakesDropped),
+		HandshakesTimedOut:   atomic.LoadUint64(&sc.stats.handshakesTimedOut),
+		HandshakesFailed:     atomic.LoadUint64(&sc.stats.handshakesFailed),
+		Connections:          connections,
+		ConnectionsRejected:  atomic.LoadUint64(&sc.stats.connectionsRejected),
+		RateLimited:          atomic.LoadUint64(&sc.stats.rateLimited),
+		AuthFailures:         atomic.LoadUint64(&sc.stats.authFailures),
+		LockoutRejections:    atomic.LoadUint64(&sc.stats.lockoutRejections),
+		LockedOutPeers:       sc.lockout.lockedOut(),
+	}
+}
+
 // Close - closes the Connection
 func (sc *Server) Close() {
 
+	sc.closeOnce.Do(func() {
+		close(sc.done)
+	})
+
+	sc.emitMutex.Lock()
+	defer sc.emitMutex.Unlock()
+
+	if sc.status == Closed {
+		return
+	}
+
 	sc.status = Closed
-	sc.listen.Close()
+	for _, l := range sc.listeners {
+		l.listen.Close() // unlinks the socket file if it's still ours
+	}
+	sc.removeManifest()
+	if sc.lock != nil {
+		sc.lock.Close()
+	}
 	close(sc.recieved)
 
 }
 
+// SendFiles - writes a message together with open files, eg. memfds, pipes or sockets (unix sockets only).
+// The reciever gets them in Message.Files. The files are duplicated, the caller can close its copies straight away.
+func (connection *Connection) SendFiles(msgType int, message []byte, files []*os.File) error {
+
+	if msgType == 0 {
+		return errors.New("Message type 0 is reserved")
+	}
+
+	if connection.files == nil {
+		return ErrFilePassingNotSupported
+	}
+
+	if len(message) > connection.maxMsgSize {
+		return errors.New("Message exceeds maximum message length")
+	}
+
+	frame, dups, err := encodeFilesFrame(connection.conn, msgType, message, files)
+	if err != nil {
+		return err
+	}
+
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+
+	if connection.status != Connected {
+		closeFiles(dups)
+		return errors.New(connection.status.String())
+	}
+
+	connection.toWrite <- &Message{MsgType: 0, Data: frame, Files: dups}
+
+	return nil
+}
+
+// PeerCredentials - returns the pid/uid/gid of the connected process, nil if the os doesn't report them
+func (connection *Connection) PeerCredentials() *PeerCredentials {
+	return connection.peer
+}
+
+// ExportKeyingMaterial - derives length bytes of keying material bound to this Connection's tls psk session (RFC 5705).
+// The client derives the same bytes from the same label and context.
+func (connection *Connection) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	return exportKeyingMaterial(connection.conn, label, context, length)
+}
+
 func (connection *Connection) Close() {
 	connection.mutex.Lock()
 	if connection.status == Closed {
@@ -1,6 +1,18 @@
 package ipc
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"github.com/jc-lab/go-tls-psk"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// ErrAbstractNotSupported - returned when an abstract socket is asked for on an os other than linux
+var ErrAbstractNotSupported = errors.New("abstract unix sockets are only supported on linux")
 
 //  returns the status of the Connection as a string
 func (status *Status) String() string {
@@ -29,11 +41,99 @@ func (status *Status) String() string {
 	}
 }
 
+// ErrInvalidName - matched by errors.Is for every NameError
+var ErrInvalidName = errors.New("invalid ipc name")
+
+// NameError - returned when an ipc name can't be used.
+//
+// Names are up to 100 characters from a-z, A-Z, 0-9, '.', '_' and '-', they can't start with '.'.
+// A leading '@' asks for a linux abstract socket and isn't counted.
+type NameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	if e.Name == "" {
+		return "ipcName " + e.Reason
+	}
+	return fmt.Sprintf("ipcName %q %s", e.Name, e.Reason)
+}
+
+func (e *NameError) Unwrap() error {
+	return ErrInvalidName
+}
+
 // checks the name passed into the start function to ensure it's ok/will work.
 func checkIpcName(ipcName string) error {
 	if len(ipcName) == 0 {
-		return errors.New("ipcName cannot be an empty string")
+		return &NameError{Name: ipcName, Reason: "cannot be an empty string"}
+	}
+
+	name := strings.TrimPrefix(ipcName, "@")
+
+	if len(name) == 0 {
+		return &NameError{Name: ipcName, Reason: "cannot be just @"}
+	}
+
+	if len(name) > maxNameLength {
+		return &NameError{Name: ipcName, Reason: fmt.Sprintf("is longer than %d characters", maxNameLength)}
+	}
+
+	if name[0] == '.' {
+		return &NameError{Name: ipcName, Reason: "cannot start with '.'"}
+	}
+
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return &NameError{Name: ipcName, Reason: fmt.Sprintf("contains %q, only letters, digits, '.', '_' and '-' are allowed", c)}
+		}
 	}
 
 	return nil
 }
+
+// splitAbstractName - strips the @ prefix used to ask for a linux abstract socket and checks the name
+func splitAbstractName(ipcName string, abstract bool) (string, bool, error) {
+	if strings.HasPrefix(ipcName, "@") {
+		ipcName = ipcName[1:]
+		abstract = true
+	}
+
+	if abstract && runtime.GOOS != "linux" {
+		return "", false, ErrAbstractNotSupported
+	}
+
+	return ipcName, abstract, checkIpcName(ipcName)
+}
+
+// isTimeout - reports whether err was caused by a deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isConnectionDropped - reports whether err means the peer closed or reset the connection
+func isConnectionDropped(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// exportKeyingMaterial - runs the RFC 5705 exporter of the tls session underneath conn
+func exportKeyingMaterial(conn net.Conn, label string, context []byte, length int) ([]byte, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, errors.New("not a tls session")
+	}
+
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		return nil, errors.New("the tls handshake has not completed")
+	}
+
+	return state.ExportKeyingMaterial(label, context, length)
+}
@@ -0,0 +1,306 @@
+package ipc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+)
+
+// shared memory control messages
+const (
+	controlShmOffer   = 2 // sent as a files message carrying the sender's ring
+	controlShmAccept  = 3 // the peer mapped the ring, large messages can use it
+	controlShmData    = 4 // a message placed in the ring
+	controlShmRelease = 5 // the reciever has copied every message up to a sequence number
+)
+
+const shmMacLabel = "EXPORTER-psk-local-ipc-shm" // exported keying material label for the shared memory MAC
+
+const shmHeaderSize = 29 // control type (1), message type (4), sequence (8), offset (8), length (8)
+
+// ErrSharedMemoryNotSupported - shared memory rings need memfd (linux)
+var ErrSharedMemoryNotSupported = errors.New("shared memory is not supported on this platform")
+
+// sharedMemory - the shared memory rings of one connection.
+//
+// Each side that enables shared memory creates a sealed memfd ring, maps it read/write and sends it
+// to the peer, which maps it read only and answers with an accept. From then on messages of at least
+// threshold bytes are copied into the sender's ring and only the offset, length and sequence number
+// travel over the tls stream, with a MAC over them and the payload. The reciever copies the payload
+// out, checks the MAC and tells the sender the space can be reused.
+//
+// Messages fall back to normal frames while the peer hasn't accepted, or when the ring is full.
+type sharedMemory struct {
+	mutex     sync.Mutex
+	sendMutex sync.Mutex // held by write() from placing a message until its control message is queued
+	threshold int
+	key       []byte // MAC key exported from the tls session
+
+	file     *os.File  // our ring until it has been offered
+	ring     []byte    // our ring, mapped read/write
+	accepted bool      // the peer has mapped our ring
+	head     int       // where the next message goes
+	inflight []shmSlot // messages the peer hasn't released yet, oldest first
+	sendSeq  uint64
+
+	peerRing []byte // the peer's ring, mapped read only
+	recvSeq  uint64
+
+	closed bool
+}
+
+// shmSlot - a message in our ring
+type shmSlot struct {
+	seq    uint64
+	offset int
+	length int
+}
+
+// newSharedMemory - creates this side's ring, returns nil if shared memory is off or can't be used on conn
+func newSharedMemory(conn net.Conn, files fileConn, size int, threshold int) *sharedMemory {
+	if size <= 0 || files == nil {
+		return nil
+	}
+
+	if threshold <= 0 {
+		threshold = sharedMemoryThreshold
+	}
+
+	key, err := exportKeyingMaterial(conn, shmMacLabel, nil, 32)
+	if err != nil {
+		return nil
+	}
+
+	file, ring, err := createSharedMemory(size)
+	if err != nil {
+		return nil
+	}
+
+	return &sharedMemory{threshold: threshold, key: key, file: file, ring: ring}
+}
+
+// offer - builds the files message handing our ring to the peer
+func (shm *sharedMemory) offer(conn net.Conn) ([]byte, []*os.File, error) {
+	shm.mutex.Lock()
+	defer shm.mutex.Unlock()
+
+	if shm.file == nil {
+		return nil, nil, errors.New("shared memory has already been offered")
+	}
+
+	frame, dups, err := encodeFilesFrame(conn, 0, []byte{controlShmOffer}, []*os.File{shm.file})
+
+	shm.file.Close()
+	shm.file = nil
+
+	return frame, dups, err
+}
+
+// acceptOffer - maps the peer's ring, returns the reply or nil if the offer is refused
+func (shm *sharedMemory) acceptOffer(message []byte, files []*os.File) []byte {
+	defer closeFiles(files) // the mapping stays valid once the file is closed
+
+	if shm == nil || len(message) != 1 || message[0] != controlShmOffer || len(files) != 1 {
+		return nil
+	}
+
+	shm.mutex.Lock()
+	defer shm.mutex.Unlock()
+
+	if shm.closed || shm.peerRing != nil {
+		return nil
+	}
+
+	peerRing, err := mapSharedMemory(files[0])
+	if err != nil {
+		return nil
+	}
+	shm.peerRing = peerRing
+
+	return []byte{controlShmAccept}
+}
+
+// peerAccepted - the peer has mapped our ring
+func (shm *sharedMemory) peerAccepted() {
+	if shm == nil {
+		return
+	}
+
+	shm.mutex.Lock()
+	shm.accepted = true
+	shm.mutex.Unlock()
+}
+
+// write - places message in the ring and passes the control message to send, returns false if the
+// message has to be sent as a normal frame instead. Writers take turns on sendMutex so the control
+// messages go out in sequence order, send is called with the ring unlocked as it can block until
+// the peer reads, which needs read() and release().
+func (shm *sharedMemory) write(msgType int, message []byte, send func(frame []byte)) bool {
+	if shm == nil || len(message) == 0 || len(message) < shm.threshold {
+		return false
+	}
+
+	shm.sendMutex.Lock()
+	defer shm.sendMutex.Unlock()
+
+	shm.mutex.Lock()
+
+	if shm.closed || !shm.accepted {
+		shm.mutex.Unlock()
+		return false
+	}
+
+	offset, ok := shm.alloc(len(message))
+	if !ok {
+		shm.mutex.Unlock()
+		return false
+	}
+
+	copy(shm.ring[offset:], message)
+	shm.head = offset + len(message)
+	shm.sendSeq++
+	shm.inflight = append(shm.inflight, shmSlot{seq: shm.sendSeq, offset: offset, length: len(message)})
+
+	frame := make([]byte, shmHeaderSize, shmHeaderSize+sha256.Size)
+	frame[0] = controlShmData
+	copy(frame[1:5], intToBytes(msgType))
+	binary.BigEndian.PutUint64(frame[5:13], shm.sendSeq)
+	binary.BigEndian.PutUint64(frame[13:21], uint64(offset))
+	binary.BigEndian.PutUint64(frame[21:29], uint64(len(message)))
+	frame = shm.mac(frame, message)
+
+	shm.mutex.Unlock()
+
+	send(frame)
+
+	return true
+}
+
+// alloc - finds length contiguous free bytes in the ring, the caller holds the mutex
+func (shm *sharedMemory) alloc(length int) (int, bool) {
+	if length > len(shm.ring) {
+		return 0, false
+	}
+
+	if len(shm.inflight) == 0 {
+		return 0, true
+	}
+
+	tail := shm.inflight[0].offset
+
+	if shm.head > tail {
+		if shm.head+length <= len(shm.ring) {
+			return shm.head, true
+		}
+		if length <= tail { // wrap around to the start
+			return 0, true
+		}
+		return 0, false
+	}
+
+	if shm.head+length <= tail {
+		return shm.head, true
+	}
+
+	return 0, false
+}
+
+// read - copies a message out of the peer's ring and checks it, returns the message type, the data
+// and the release message for the peer.
+func (shm *sharedMemory) read(frame []byte) (int, []byte, []byte, error) {
+	if shm == nil {
+		return 0, nil, nil, ErrSharedMemoryNotSupported
+	}
+
+	if len(frame) != shmHeaderSize+sha256.Size {
+		return 0, nil, nil, errors.New("shared memory message is the wrong length")
+	}
+
+	shm.mutex.Lock()
+	defer shm.mutex.Unlock()
+
+	if shm.peerRing == nil || shm.closed {
+		return 0, nil, nil, errors.New("shared memory message recieved without a shared memory ring")
+	}
+
+	seq := binary.BigEndian.Uint64(frame[5:13])
+	offset := binary.BigEndian.Uint64(frame[13:21])
+	length := binary.BigEndian.Uint64(frame[21:29])
+
+	if seq != shm.recvSeq+1 {
+		return 0, nil, nil, errors.New("shared memory message is out of sequence")
+	}
+
+	if offset > uint64(len(shm.peerRing)) || length > uint64(len(shm.peerRing))-offset {
+		return 0, nil, nil, errors.New("shared memory message is outside the ring")
+	}
+
+	// copy first, the peer can still write to the ring
+	message := make([]byte, length)
+	copy(message, shm.peerRing[offset:offset+length])
+
+	if !hmac.Equal(shm.mac(frame[:shmHeaderSize:shmHeaderSize], message)[shmHeaderSize:], frame[shmHeaderSize:]) {
+		return 0, nil, nil, errors.New("shared memory message failed verification")
+	}
+
+	shm.recvSeq = seq
+
+	release := make([]byte, 9)
+	release[0] = controlShmRelease
+	binary.BigEndian.PutUint64(release[1:], seq)
+
+	return bytesToInt(frame[1:5]), message, release, nil
+}
+
+// release - frees every message up to the sequence number in the peer's release message
+func (shm *sharedMemory) release(frame []byte) {
+	if shm == nil || len(frame) != 9 {
+		return
+	}
+
+	seq := binary.BigEndian.Uint64(frame[1:])
+
+	shm.mutex.Lock()
+	defer shm.mutex.Unlock()
+
+	for len(shm.inflight) > 0 && shm.inflight[0].seq <= seq {
+		shm.inflight = shm.inflight[1:]
+	}
+}
+
+// mac - appends the MAC over the header and message to header
+func (shm *sharedMemory) mac(header []byte, message []byte) []byte {
+	mac := hmac.New(sha256.New, shm.key)
+	mac.Write(header)
+	mac.Write(message)
+	return mac.Sum(header)
+}
+
+// close - unmaps both rings, called once the connection has gone
+func (shm *sharedMemory) close() {
+	if shm == nil {
+		return
+	}
+
+	shm.mutex.Lock()
+	defer shm.mutex.Unlock()
+
+	if shm.closed {
+		return
+	}
+	shm.closed = true
+
+	if shm.file != nil {
+		shm.file.Close()
+	}
+	if shm.ring != nil {
+		unmapSharedMemory(shm.ring)
+	}
+	if shm.peerRing != nil {
+		unmapSharedMemory(shm.peerRing)
+	}
+}
@@ -0,0 +1,73 @@
+//go:build linux
+// +build linux
+
+package ipc
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// createSharedMemory - creates a memfd of size bytes (rounded up to whole pages) and maps it
+// read/write. The size is sealed so the peer's mapping can't be cut short.
+func createSharedMemory(size int) (*os.File, []byte, error) {
+	if size > maxSharedMemorySize {
+		return nil, nil, errors.New("shared memory size is too big")
+	}
+
+	pageSize := os.Getpagesize()
+	size = (size + pageSize - 1) / pageSize * pageSize
+
+	fd, err := unix.MemfdCreate("psk-local-ipc", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return nil, nil, err
+	}
+	file := os.NewFile(uintptr(fd), "psk-local-ipc-shm")
+
+	if err := unix.Ftruncate(fd, int64(size)); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_SEAL); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	ring, err := unix.Mmap(fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, ring, nil
+}
+
+// mapSharedMemory - maps a ring recieved from the peer read only, it must be sealed against shrinking
+func mapSharedMemory(file *os.File) ([]byte, error) {
+	fd := int(file.Fd())
+
+	seals, err := unix.FcntlInt(uintptr(fd), unix.F_GET_SEALS, 0)
+	if err != nil {
+		return nil, err
+	}
+	if seals&unix.F_SEAL_SHRINK == 0 {
+		return nil, errors.New("shared memory isn't sealed against shrinking")
+	}
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return nil, err
+	}
+	if stat.Size <= 0 || stat.Size > maxSharedMemorySize {
+		return nil, errors.New("shared memory is the wrong size")
+	}
+
+	return unix.Mmap(fd, 0, int(stat.Size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+func unmapSharedMemory(ring []byte) {
+	unix.Munmap(ring)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package ipc
+
+import "os"
+
+func createSharedMemory(size int) (*os.File, []byte, error) {
+	return nil, nil, ErrSharedMemoryNotSupported
+}
+
+func mapSharedMemory(file *os.File) ([]byte, error) {
+	return nil, ErrSharedMemoryNotSupported
+}
+
+func unmapSharedMemory(ring []byte) {}
@@ -0,0 +1,43 @@
+package ipc
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// CloseOnSignal - closes the server when the process gets one of signals (SIGTERM and SIGINT if none
+// are given), so the socket file is unlinked and any lock file released, then raises the signal
+// again so the process exits the way it would have. The returned function stops watching.
+func (sc *Server) CloseOnSignal(signals ...os.Signal) func() {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+
+	stop := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		select {
+		case sig := <-c:
+			sc.Close()
+
+			signal.Reset(sig)
+			if p, err := os.FindProcess(os.Getpid()); err != nil || p.Signal(sig) != nil {
+				os.Exit(1)
+			}
+		case <-stop:
+			signal.Stop(c)
+		}
+	}()
+
+	return func() {
+		once.Do(func() {
+			close(stop)
+		})
+	}
+}
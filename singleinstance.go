@@ -0,0 +1,209 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// message types used between the instances
+const (
+	instanceArgs = 1 // json encoded instanceForward
+	instanceDone = 2 // the primary has handled the arguments
+)
+
+// ErrInstanceLocked - the lock file is held by another process
+var ErrInstanceLocked = errors.New("the instance lock is held by another process")
+
+// Instance - the primary instance returned by SingleInstance. Its server is read by SingleInstance
+// itself, so it isn't exposed.
+type Instance struct {
+	server *Server
+}
+
+// instanceForward - what a second instance sends to the primary
+type instanceForward struct {
+	Args []string `json:"args"`
+	Cwd  string   `json:"cwd"`
+}
+
+// SingleInstance - makes this process the only one running as ipcName.
+//
+// The name is claimed with a lock file next to the socket (<socket>.lock, or <name>.lock in the
+// temp directory for transports without socket files). The first process gets an Instance and
+// exit = false, onSecondInstance is then called with the arguments (without the program name) and
+// working directory of every process started later. Those processes get exit = true once the
+// primary has handled their arguments and should exit, err is set if the arguments couldn't be forwarded.
+func SingleInstance(ipcName string, config *ServerConfig, onSecondInstance func(args []string, cwd string)) (*Instance, bool, error) {
+	if config == nil {
+		return nil, false, errors.New("config is required")
+	}
+
+	err := checkIpcName(ipcName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	name, abstract, err := splitAbstractName(ipcName, config.Abstract)
+	if err != nil {
+		return nil, false, err
+	}
+
+	lockPath, err := instanceLockPath(name, abstract, config)
+	if err != nil {
+		return nil, false, err
+	}
+
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = lockFile(lock)
+	if err == ErrInstanceLocked {
+		lock.Close()
+		return nil, true, forwardToInstance(ipcName, config)
+	} else if err != nil {
+		lock.Close()
+		return nil, false, err
+	}
+
+	sc, err := StartServer(ipcName, config)
+	if err != nil {
+		lock.Close()
+		return nil, false, err
+	}
+
+	sc.lock = lock // released by sc.Close()
+
+	go serveInstance(sc, onSecondInstance)
+
+	return &Instance{server: sc}, false, nil
+}
+
+// Close - stops the server and releases the name, the same as Server.Close()
+func (in *Instance) Close() {
+	in.server.Close()
+}
+
+func serveInstance(sc *Server, onSecondInstance func(args []string, cwd string)) {
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			if sc.Status() == Closed {
+				return
+			}
+			continue
+		}
+
+		if m.MsgType != instanceArgs {
+			continue
+		}
+
+		var forward instanceForward
+		if json.Unmarshal(m.Data, &forward) == nil && onSecondInstance != nil {
+			onSecondInstance(forward.Args, forward.Cwd)
+		}
+
+		m.Connection.Write(instanceDone, nil)
+	}
+}
+
+// forwardToInstance - sends this process's arguments to the primary and waits until it has them
+func forwardToInstance(ipcName string, config *ServerConfig) error {
+	cwd, _ := os.Getwd()
+
+	data, err := json.Marshal(instanceForward{Args: os.Args[1:], Cwd: cwd})
+	if err != nil {
+		return err
+	}
+
+	cc, err := StartClient(ipcName, instanceClientConfig(config))
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	// after a timeout the reads carry on until the client gives up connecting or reports the
+	// closed connection, so the go routine doesn't wait on it forever
+	result := make(chan error, 1)
+	timedOut := make(chan struct{})
+	go func() {
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				select {
+				case result <- err:
+				default:
+				}
+				return
+			}
+
+			switch {
+			case m.MsgType == -1 && m.Status == Connected:
+				select {
+				case <-timedOut: // connected too late, the arguments aren't wanted any more
+					cc.Close()
+					continue
+				default:
+				}
+
+				if err := cc.Write(instanceArgs, data); err != nil {
+					result <- err
+					return
+				}
+			case m.MsgType == instanceDone:
+				result <- nil
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(instanceTimeout):
+		close(timedOut) // closes the connection if it's only made now, the deferred Close closes it otherwise
+		return errors.New("timed out forwarding the arguments to the running instance")
+	}
+}
+
+// instanceClientConfig - a client config reaching the server that config starts, the socket is found
+// from the same fields the server's transport is built from
+func instanceClientConfig(config *ServerConfig) *ClientConfig {
+	return &ClientConfig{
+		SocketDirectory: config.SocketDirectory,
+		AppName:         config.AppName,
+		DirectoryMode:   config.DirectoryMode,
+		Timeout:         instanceTimeout.Seconds(),
+		PskConfig:       config.PskConfig,
+		Abstract:        config.Abstract,
+		Transport:       config.Transport,
+	}
+}
+
+// instanceLockPath - the lock file sits next to the socket file when there is one, the directory is
+// created first as the server would
+func instanceLockPath(name string, abstract bool, config *ServerConfig) (string, error) {
+	transport := config.Transport
+	if transport == nil {
+		transport = defaultTransport(abstract, config)
+	}
+
+	if addresser, ok := transport.(listenAddresser); ok {
+		if address := addresser.listenAddress(name); !strings.HasPrefix(address, "@") {
+			if preparer, ok := transport.(directoryPreparer); ok {
+				if err := preparer.prepareDirectory(); err != nil {
+					return "", err
+				}
+			}
+
+			return address + ".lock", nil
+		}
+	}
+
+	return filepath.Join(os.TempDir(), name+".lock"), nil
+}
@@ -0,0 +1,12 @@
+//go:build darwin
+// +build darwin
+
+package ipc
+
+import "context"
+
+// waitForSocket - there's no directory watching on darwin, the client just waits for ctx (RetryTimer)
+// before dialing again
+func waitForSocket(ctx context.Context, path string) {
+	<-ctx.Done()
+}
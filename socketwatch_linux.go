@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package ipc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitForSocket - returns when the socket file at path is created or replaced, or when ctx is done.
+//
+// The directory is watched with inotify. If it doesn't exist yet the nearest existing parent is
+// watched instead and waitForSocket returns once the next directory down is created, the caller
+// dials and waits again. Anything that goes wrong with inotify falls back to waiting for ctx.
+func waitForSocket(ctx context.Context, path string) {
+	if err := watchSocket(ctx, path); err != nil {
+		<-ctx.Done()
+	}
+}
+
+func watchSocket(ctx context.Context, path string) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+
+	// non-blocking so reads go through the runtime poller and honour deadlines
+	file := os.NewFile(uintptr(fd), "inotify")
+	defer file.Close()
+
+	before, beforeErr := os.Lstat(path)
+
+	target := filepath.Clean(path)
+	for {
+		dir := filepath.Dir(target)
+
+		_, err = unix.InotifyAddWatch(fd, dir, unix.IN_CREATE|unix.IN_MOVED_TO|unix.IN_DELETE_SELF|unix.IN_MOVE_SELF)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, unix.ENOENT) || dir == target {
+			return err
+		}
+
+		target = dir
+	}
+
+	// the socket may have changed while the watch was being added
+	after, afterErr := os.Lstat(path)
+	if (beforeErr == nil) != (afterErr == nil) || (beforeErr == nil && !os.SameFile(before, after)) {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		file.SetReadDeadline(deadline)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			file.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	base := filepath.Base(target)
+	buf := make([]byte, 4096)
+
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+			if offset > n {
+				break
+			}
+
+			if event.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_IGNORED|unix.IN_Q_OVERFLOW) != 0 {
+				return nil // the directory has gone, or events were lost
+			}
+
+			name := string(buf[nameStart:offset])
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+
+			if name == base {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+//go:build linux
+// +build linux
+
+package ipc
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sdListenFdsStart - first file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START)
+var sdListenFdsStart = 3
+
+// activationListener - returns the listener systemd passed for name (LISTEN_FDS/LISTEN_PID/LISTEN_FDNAMES),
+// nil if there isn't one. A socket matches if its FileDescriptorName= is the ipc name or if it's bound to address.
+func activationListener(name string, address string) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	adoptedFds.Lock()
+	defer adoptedFds.Unlock()
+
+	for i := 0; i < count; i++ {
+		fd := sdListenFdsStart + i
+		if adoptedFds.fds[fd] {
+			continue
+		}
+
+		match := i < len(names) && names[i] == name
+		if !match && address != "" {
+			match = boundAddress(fd) == address
+		}
+		if !match {
+			continue
+		}
+
+		listen, err := adoptFd(fd, name)
+		clearActivationEnv(count)
+		return listen, err
+	}
+
+	return nil, nil
+}
+
+// clearActivationEnv - once every socket systemd passed has been taken the settings are removed,
+// like sd_listen_fds(1), so processes started later don't look at them. The caller holds adoptedFds.
+func clearActivationEnv(count int) {
+	for i := 0; i < count; i++ {
+		if !adoptedFds.fds[sdListenFdsStart+i] {
+			return
+		}
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+}
+
+// sdNotify - sends state (eg. READY=1) to the systemd NOTIFY_SOCKET, does nothing if it isn't set
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+package ipc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSocketActivation(t *testing.T) {
+	name := RAND_VALUE + "test_activation"
+	dir := t.TempDir()
+
+	// what systemd would have created from the .socket unit
+	listen, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "activated.sock"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen.SetUnlinkOnClose(false)
+	f, err := listen.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen.Close()
+
+	oldStart := sdListenFdsStart
+	sdListenFdsStart = int(f.Fd())
+	defer func() {
+		sdListenFdsStart = oldStart
+	}()
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", name)
+
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "notify"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notify.Close()
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(dir, "notify"))
+
+	// the server would create its own socket in another directory if it didn't adopt the inherited one
+	sc, err := StartServer(name, &ServerConfig{PskConfig: defaultPskConfig, SocketDirectory: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	waitServerReady(t, sc)
+
+	if os.Getenv("LISTEN_FDS") != "" || os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDNAMES") != "" {
+		t.Error("the activation settings should be removed once the socket has been adopted")
+	}
+
+	buf := make([]byte, 64)
+	notify.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := notify.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("should have sent READY=1, got %q", buf[:n])
+	}
+
+	cc, err := StartClient("activated", &ClientConfig{PskConfig: defaultPskConfig, SocketDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	go func() {
+		for {
+			if _, err := cc.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == Connected {
+			break
+		}
+	}
+}
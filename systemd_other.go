@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package ipc
+
+import "net"
+
+// activationListener - socket activation is linux only
+func activationListener(name string, address string) (net.Listener, error) {
+	return nil, nil
+}
+
+// sdNotify - systemd is linux only
+func sdNotify(state string) error {
+	return nil
+}
@@ -0,0 +1,301 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Transport - creates the listening socket for the server and connects the client to it.
+//
+// name is the ipc name passed to StartServer/StartClient. The tls psk layer and the ipc handshake
+// run on top of whatever net.Conn the transport returns, so a transport can wrap another one,
+// eg. to add tracing or to dial from inside a different network namespace.
+//
+// Dial should return an error matching ErrNotListening (or the os "no such file"/"connection refused"
+// errors) while there is no server, the client then retries after RetryTimer.
+type Transport interface {
+	Listen(name string) (net.Listener, error)
+	Dial(ctx context.Context, name string) (net.Conn, error)
+}
+
+// ErrNotListening - returned by Transport.Dial when no server is listening on the name yet
+var ErrNotListening = errors.New("no server is listening")
+
+// ErrAlreadyRunning - returned by StartServer (and Transport.Listen) when a live server is already
+// listening on the name
+var ErrAlreadyRunning = errors.New("a server is already listening on this name")
+
+// ErrSocketPathTooLong - the socket file path doesn't fit in a unix socket address and couldn't be shortened
+var ErrSocketPathTooLong = errors.New("socket path is too long")
+
+// ErrInsecureDirectory - the socket directory could be tampered with by another user
+var ErrInsecureDirectory = errors.New("insecure socket directory")
+
+// listenWaiter - implemented by transports that can tell when a server starts listening,
+// the client waits on it instead of sleeping for RetryTimer between dials.
+type listenWaiter interface {
+	waitListening(ctx context.Context, name string)
+}
+
+// listenAddresser - implemented by transports that listen on a unix socket, the address is used
+// to find the matching socket when listeners are inherited from systemd.
+type listenAddresser interface {
+	listenAddress(name string) string
+}
+
+// directoryPreparer - implemented by transports that keep their socket files in a directory of
+// their own, it's created before anything is put in it.
+type directoryPreparer interface {
+	prepareDirectory() error
+}
+
+// streamDialer - implemented by transports that may connect to something other than the server's
+// stream socket, the client falls back to the stream socket with it when a handshake fails.
+type streamDialer interface {
+	dialStream(ctx context.Context, name string) (net.Conn, error)
+}
+
+// createListenSocket - default listener provider, asks the transport for the listening socket
+func (sc *Server) createListenSocket() (net.Listener, error) {
+	return sc.transport.Listen(sc.name)
+}
+
+// dial - default connection provider, keeps asking the transport to connect until the
+// server is there or the client times out.
+func (cc *Client) dial() (net.Conn, error) {
+	startTime := time.Now()
+	autoStarted := false
+	refusedDelay := time.Duration(0)
+
+	for {
+		if cc.timeout != 0 {
+			if time.Now().Sub(startTime).Seconds() > cc.timeout {
+				cc.setStatus(Closed)
+				return nil, errors.New("Timed out trying to connect")
+			}
+		}
+
+		conn, err := cc.dialOnce()
+		if err == nil {
+			return conn, nil
+		}
+
+		if !isNotListening(err) {
+			return nil, err
+		}
+
+		if cc.autoStart != nil && !autoStarted {
+			autoStarted = true
+
+			conn, err := cc.autoStartServer()
+			if err != nil {
+				return nil, err
+			}
+			if conn != nil {
+				return conn, nil
+			}
+			continue // another client is starting the server
+		}
+
+		if waiter, ok := cc.transport.(listenWaiter); ok {
+			// the socket appears at bind(), just before the server listens, so a refused dial is
+			// retried shortly. The delay doubles in case it's a stale socket, up to RetryTimer, and
+			// starts again whenever the watched directory changes.
+			if errors.Is(err, syscall.ECONNREFUSED) && refusedDelay < cc.retryTimer*time.Second {
+				if refusedDelay == 0 {
+					refusedDelay = refusedRetryDelay
+				} else {
+					refusedDelay *= 2
+				}
+				time.Sleep(refusedDelay)
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), cc.retryTimer*time.Second)
+			waiter.waitListening(ctx, cc.name)
+			if ctx.Err() == nil {
+				refusedDelay = 0
+			}
+			cancel()
+		} else {
+			time.Sleep(cc.retryTimer * time.Second)
+		}
+	}
+}
+
+// dialOnce - a single Transport.Dial attempt
+func (cc *Client) dialOnce() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	return cc.transport.Dial(ctx, cc.name)
+}
+
+// AbstractTransport - linux abstract unix sockets, they don't leave files behind but have no file
+// permissions either so the server defaults to the SameUser PeerPolicy.
+type AbstractTransport struct{}
+
+// Listen - listen on the abstract socket @name
+func (t AbstractTransport) Listen(name string) (net.Listener, error) {
+	if runtime.GOOS != "linux" {
+		return nil, ErrAbstractNotSupported
+	}
+
+	listen, err := net.Listen("unix", "@"+name)
+	if errors.Is(err, syscall.EADDRINUSE) { // abstract sockets go away with their process
+		return nil, ErrAlreadyRunning
+	}
+
+	return listen, err
+}
+
+func (t AbstractTransport) listenAddress(name string) string {
+	return "@" + name
+}
+
+// Dial - connect to the abstract socket @name
+func (t AbstractTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	if runtime.GOOS != "linux" {
+		return nil, ErrAbstractNotSupported
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", "@"+name)
+}
+
+// TCPLoopbackTransport - tcp on 127.0.0.1, for platforms or sandboxes without unix sockets.
+//
+// If Port is 0 the server listens on a random port and writes it to <Directory>/<name>.port for
+// the client to find. Anyone on the machine can connect so the psk is the only protection,
+// peer credentials and peer policies are not available.
+type TCPLoopbackTransport struct {
+	Port      int
+	Directory string // where the port files are kept, defaults to os.TempDir()
+}
+
+func (t TCPLoopbackTransport) portFile(name string) string {
+	dir := t.Directory
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, name+".port")
+}
+
+// Listen - listen on the loopback interface
+func (t TCPLoopbackTransport) Listen(name string) (net.Listener, error) {
+	if t.Port == 0 {
+		// don't take the port file over from a live server
+		ctx, cancel := context.WithTimeout(context.Background(), staleSocketTimeout)
+		conn, err := t.Dial(ctx, name)
+		cancel()
+		if err == nil {
+			conn.Close()
+			return nil, ErrAlreadyRunning
+		}
+	}
+
+	listen, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(t.Port)))
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, ErrAlreadyRunning
+	} else if err != nil {
+		return nil, err
+	}
+
+	if t.Port != 0 {
+		return listen, nil
+	}
+
+	portFile := t.portFile(name)
+	port := listen.Addr().(*net.TCPAddr).Port
+
+	err = ioutil.WriteFile(portFile, []byte(strconv.Itoa(port)), 0600)
+	if err != nil {
+		listen.Close()
+		return nil, err
+	}
+
+	return &portFileListener{Listener: listen, path: portFile}, nil
+}
+
+// Dial - connect to the loopback port
+func (t TCPLoopbackTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	port := t.Port
+
+	if port == 0 {
+		b, err := ioutil.ReadFile(t.portFile(name))
+		if os.IsNotExist(err) {
+			return nil, ErrNotListening
+		} else if err != nil {
+			return nil, err
+		}
+
+		port, err = strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port file: %w", err)
+		}
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+}
+
+// portFileListener - removes the port file when the listener is closed
+type portFileListener struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+// keepFile - the port file is handed to another process with the listener, Close mustn't remove it
+func (l *portFileListener) keepFile() {
+	l.once.Do(func() {})
+}
+
+// File - a duplicate of the listening socket
+func (l *portFileListener) File() (*os.File, error) {
+	return l.Listener.(*net.TCPListener).File()
+}
+
+func (l *portFileListener) Close() error {
+	l.once.Do(func() {
+		os.Remove(l.path)
+	})
+	return l.Listener.Close()
+}
+
+// ErrCannotReconnect - returned when a client created from an existing connection loses it
+var ErrCannotReconnect = errors.New("the connection was passed to NewClientFromConn and can't be re-established")
+
+// connTransport - hands out the connection passed to NewClientFromConn, once
+type connTransport struct {
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func (t *connTransport) Listen(name string) (net.Listener, error) {
+	return nil, errors.New("connTransport can't listen")
+}
+
+func (t *connTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	conn := t.conn
+	t.conn = nil
+	if conn == nil {
+		return nil, ErrCannotReconnect
+	}
+
+	return conn, nil
+}
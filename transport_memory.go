@@ -0,0 +1,362 @@
+package ipc
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// memoryListeners - process wide table of in-memory listeners by name
+var memoryListeners = struct {
+	sync.Mutex
+	byName  map[string]*memoryListener
+	changed chan struct{} // closed and replaced whenever a listener is added
+}{byName: make(map[string]*memoryListener), changed: make(chan struct{})}
+
+// MemoryTransport - in-process connections, listeners are registered by name in a process wide table.
+//
+// Connections are buffered pipes that behave like a socket (writes don't wait for the reader until
+// the buffer is full, deadlines are supported) and clients are woken as soon as the server starts
+// listening, so tests don't need sleeps and never touch the filesystem.
+type MemoryTransport struct{}
+
+// Listen - registers name in the process wide table
+func (t MemoryTransport) Listen(name string) (net.Listener, error) {
+	memoryListeners.Lock()
+	defer memoryListeners.Unlock()
+
+	if _, ok := memoryListeners.byName[name]; ok {
+		return nil, ErrAlreadyRunning
+	}
+
+	l := &memoryListener{
+		name:  name,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	memoryListeners.byName[name] = l
+
+	close(memoryListeners.changed)
+	memoryListeners.changed = make(chan struct{})
+
+	return l, nil
+}
+
+// Dial - connects to the listener registered as name
+func (t MemoryTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	memoryListeners.Lock()
+	l := memoryListeners.byName[name]
+	memoryListeners.Unlock()
+
+	if l == nil {
+		return nil, ErrNotListening
+	}
+
+	client, server := newMemoryPipe(name)
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, ErrNotListening
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// waitListening - returns once a listener is registered as name, or when ctx is done
+func (t MemoryTransport) waitListening(ctx context.Context, name string) {
+	for {
+		memoryListeners.Lock()
+		_, ok := memoryListeners.byName[name]
+		changed := memoryListeners.changed
+		memoryListeners.Unlock()
+
+		if ok {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type memoryListener struct {
+	name  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		memoryListeners.Lock()
+		if memoryListeners.byName[l.name] == l {
+			delete(memoryListeners.byName, l.name)
+		}
+		memoryListeners.Unlock()
+
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return memoryAddr(l.name)
+}
+
+// memoryAddr - net.Addr of an in-memory listener
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+// newMemoryPipe - returns both ends of a buffered in-memory connection
+func newMemoryPipe(name string) (net.Conn, net.Conn) {
+	a := newMemoryBuffer()
+	b := newMemoryBuffer()
+
+	client := &memoryConn{addr: memoryAddr(name), in: a, out: b, done: make(chan struct{}),
+		readDeadline: makeMemoryDeadline(), writeDeadline: makeMemoryDeadline()}
+	server := &memoryConn{addr: memoryAddr(name), in: b, out: a, done: make(chan struct{}),
+		readDeadline: makeMemoryDeadline(), writeDeadline: makeMemoryDeadline()}
+
+	return client, server
+}
+
+// memoryBuffer - one direction of a memory pipe, holds up to memoryPipeSize bytes
+type memoryBuffer struct {
+	mutex   sync.Mutex
+	buf     []byte
+	closed  bool
+	changed chan struct{} // closed and replaced whenever buf or closed changes
+}
+
+func newMemoryBuffer() *memoryBuffer {
+	return &memoryBuffer{changed: make(chan struct{})}
+}
+
+// signal - wakes up anyone waiting on the buffer, the caller holds the mutex
+func (mb *memoryBuffer) signal() {
+	close(mb.changed)
+	mb.changed = make(chan struct{})
+}
+
+func (mb *memoryBuffer) close() {
+	mb.mutex.Lock()
+	if !mb.closed {
+		mb.closed = true
+		mb.signal()
+	}
+	mb.mutex.Unlock()
+}
+
+func (mb *memoryBuffer) read(b []byte, deadline <-chan struct{}, done <-chan struct{}) (int, error) {
+	for {
+		select {
+		case <-done:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+
+		mb.mutex.Lock()
+		if len(mb.buf) > 0 {
+			n := copy(b, mb.buf)
+			mb.buf = mb.buf[n:]
+			mb.signal()
+			mb.mutex.Unlock()
+			return n, nil
+		}
+		if mb.closed {
+			mb.mutex.Unlock()
+			return 0, io.EOF
+		}
+		changed := mb.changed
+		mb.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		case <-done:
+			return 0, io.ErrClosedPipe
+		}
+	}
+}
+
+func (mb *memoryBuffer) write(b []byte, deadline <-chan struct{}, done <-chan struct{}) (int, error) {
+	n := 0
+
+	for len(b) > 0 {
+		select {
+		case <-done:
+			return n, io.ErrClosedPipe
+		default:
+		}
+
+		mb.mutex.Lock()
+		if mb.closed {
+			mb.mutex.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if space := memoryPipeSize - len(mb.buf); space > 0 {
+			if space > len(b) {
+				space = len(b)
+			}
+			mb.buf = append(mb.buf, b[:space]...)
+			b = b[space:]
+			n += space
+			mb.signal()
+			mb.mutex.Unlock()
+			continue
+		}
+		changed := mb.changed
+		mb.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return n, os.ErrDeadlineExceeded
+		case <-done:
+			return n, io.ErrClosedPipe
+		}
+	}
+
+	return n, nil
+}
+
+// memoryConn - one end of a memory pipe
+type memoryConn struct {
+	addr          memoryAddr
+	in            *memoryBuffer
+	out           *memoryBuffer
+	done          chan struct{}
+	once          sync.Once
+	readDeadline  memoryDeadline
+	writeDeadline memoryDeadline
+}
+
+func (c *memoryConn) Read(b []byte) (int, error) {
+	return c.in.read(b, c.readDeadline.wait(), c.done)
+}
+
+func (c *memoryConn) Write(b []byte) (int, error) {
+	return c.out.write(b, c.writeDeadline.wait(), c.done)
+}
+
+func (c *memoryConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.in.close()
+		c.out.close()
+	})
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// memoryDeadline - the cancel channel is closed once the deadline has passed, the same as net.Pipe
+type memoryDeadline struct {
+	mutex  sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeMemoryDeadline() memoryDeadline {
+	return memoryDeadline{cancel: make(chan struct{})}
+}
+
+func (d *memoryDeadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *memoryDeadline) wait() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -3,21 +3,80 @@ package ipc
 import (
 	"github.com/jc-lab/go-tls-psk"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
 // Server - holds the details of the server Connection & config.
 type Server struct {
-	socketDirectory    string
-	name               string
-	listen             net.Listener
-	status             Status
-	recieved           chan (*Message)
-	maxMsgSize         int
-	unMask             int
-	securityDescriptor string
-	pskConfig          tls.PSKConfig
+	socketDirectory  string
+	name             string
+	abstract         bool
+	peerPolicy       PeerPolicy
+	listeners        []*Listener // the first one is created by StartServer, guarded by emitMutex
+	status           Status
+	recieved         chan (*Message)
+	maxMsgSize       int
+	transport        Transport
+	pskConfig        tls.PSKConfig
+	handshakeTimeout time.Duration
+	handshakeSlots   chan struct{} // one entry per handshake in progress
+	stats            *serverStats
+	done             chan struct{}
+	closeOnce        sync.Once
+	emitMutex        sync.RWMutex
+
+	maxConnections       int
+	maxConnectionsPerUID int
+	overflowAction       OverflowAction
+	messageRate          float64
+	messageBurst         int
+	byteRate             float64
+	byteBurst            int
+	connMutex            sync.Mutex
+	connections          map[*Connection]struct{}
+	connectionsPerUID    map[int]int
+	connectionsChanged   chan struct{} // closed and replaced whenever a Connection is removed
+	lockout              *lockoutTracker
+	auditHook            func(event AuditEvent)
+
+	sharedMemorySize      int
+	sharedMemoryThreshold int
+
+	lock          *os.File // lock file held while the server runs, eg. by SingleInstance
+	manifestPath  string   // set once the manifest has been written
+	manifestStart time.Time
+
+	drainTimeout  time.Duration
+	handingOff    bool // set by Handoff, guarded by connMutex
+	releaseStderr bool
+}
+
+// serverStats - counters behind Server.Stats(), updated atomically
+type serverStats struct {
+	handshakesInProgress uint64
+	handshakesDropped    uint64
+	handshakesTimedOut   uint64
+	handshakesFailed     uint64
+	connectionsRejected  uint64
+	rateLimited          uint64
+	authFailures         uint64
+	lockoutRejections    uint64
+}
+
+// ServerStats - snapshot of the server counters returned by Server.Stats()
+type ServerStats struct {
+	HandshakesInProgress uint64 // accepted connections still handshaking
+	HandshakesDropped    uint64 // connections closed because MaxPendingHandshakes was reached
+	HandshakesTimedOut   uint64 // handshakes that didn't finish within HandshakeTimeout
+	HandshakesFailed     uint64 // handshakes that failed for any other reason (bad psk, wrong version...)
+	Connections          int    // connections currently registered, including ones still handshaking
+	ConnectionsRejected  uint64 // connections refused because of MaxConnections or MaxConnectionsPerUID
+	RateLimited          uint64 // recieved messages that went over the message or byte rate limits
+	AuthFailures         uint64 // tls psk handshakes that failed, eg. wrong key or identity, or not tls
+	LockoutRejections    uint64 // connections refused because the peer was locked out
+	LockedOutPeers       int    // peers currently locked out
 }
 
 // Connection
@@ -27,12 +86,29 @@ type Connection struct {
 	status     Status
 	toWrite    chan (*Message)
 	mutex      *sync.Mutex
+	peer       *PeerCredentials
+	msgBucket  *tokenBucket
+	byteBucket *tokenBucket
+	files      fileConn      // nil unless the transport can pass file descriptors
+	shm        *sharedMemory // nil unless shared memory is enabled and supported
+	listener   *Listener     // the listener the Connection was accepted on
+	goneAway   bool          // the goodbye has been queued, guarded by mutex
+}
+
+// PeerCredentials - the process on the other end of a Connection, as reported by the os
+type PeerCredentials struct {
+	PID int
+	UID int
+	GID int // -1 if not known
 }
 
 // Client - holds the details of the client Connection and config.
 type Client struct {
 	socketDirectory string
 	name            string
+	abstract        bool
+	peerPolicy      PeerPolicy
+	transport       Transport
 	conn            net.Conn
 	status          Status
 	timeout         float64       //
@@ -41,6 +117,14 @@ type Client struct {
 	toWrite         chan (*Message)
 	maxMsgSize      int
 	pskConfig       tls.PSKConfig
+	files           fileConn      // nil unless the transport can pass file descriptors
+	shm             *sharedMemory // nil unless shared memory is enabled and supported
+	mutex           sync.Mutex    // guards conn, status, maxMsgSize, files and shm
+
+	sharedMemorySize      int
+	sharedMemoryThreshold int
+
+	autoStart *AutoStart // nil unless the client starts the server itself
 }
 
 // Message - contains the  recieved message
@@ -50,6 +134,7 @@ type Message struct {
 	err        error  // details of any error
 	Data       []byte // message data recieved
 	Status     Status
+	Files      []*os.File // files sent with SendFiles(), the reciever must close them
 }
 
 // Status - Status of the Connection
@@ -86,6 +171,64 @@ type ServerConfig struct {
 	Unmask             int
 	SecurityDescriptor string
 	PskConfig          tls.PSKConfig
+	// HandshakeTimeout - time allowed for the tls and ipc handshakes, 0 uses the default (10s), -1 never times out
+	HandshakeTimeout time.Duration
+	// MaxPendingHandshakes - connections accepted while this many handshakes are in progress are dropped, defaults to 32
+	MaxPendingHandshakes int
+	// MaxConnections - maximum number of open connections, 0 is unlimited
+	MaxConnections int
+	// MaxConnectionsPerUID - maximum number of open connections for each peer uid, 0 is unlimited (unix only)
+	MaxConnectionsPerUID int
+	// MessageRateLimit / MessageBurst - recieved messages per second allowed on each Connection, 0 is unlimited
+	MessageRateLimit float64
+	MessageBurst     int
+	// ByteRateLimit / ByteBurst - recieved bytes per second allowed on each Connection, 0 is unlimited
+	ByteRateLimit float64
+	ByteBurst     int
+	// OverflowAction - what happens when one of the limits above is hit, the default is OverflowReject
+	OverflowAction OverflowAction
+	// Lockout - locks out peers after repeated failed psk handshakes, nil disables it. Peers are
+	// keyed by uid unless KeyByPID is set, so a process of the same user can lock the clients out.
+	Lockout *LockoutPolicy
+	// AuditHook - called for every failed handshake and lockout, it must not block
+	AuditHook func(event AuditEvent)
+	// Abstract - listen on a linux abstract socket instead of a socket file, the same as prefixing the name with @
+	Abstract bool
+	// PeerPolicy - checks the credentials of every connecting process, defaults to SameUser for abstract sockets
+	PeerPolicy PeerPolicy
+	// Transport - creates the listening socket, defaults to unix sockets (named pipes on windows)
+	// built from SocketDirectory, Unmask and SecurityDescriptor
+	Transport Transport
+	// SharedMemorySize - size of the shared memory ring used to send large messages to each client,
+	// 0 turns it off. Both sides have to enable it (linux unix sockets only).
+	SharedMemorySize int
+	// SharedMemoryThreshold - messages of at least this many bytes go through shared memory, defaults to 64KiB
+	SharedMemoryThreshold int
+	// SocketMode - permissions of the socket file, eg. 0660. Applied before the socket can be reached,
+	// without changing the process umask. Takes precedence over UseUnmask/Unmask (unix only).
+	SocketMode os.FileMode
+	// SocketOwner / SocketGroup - user and group (names or numeric ids) given the socket file (unix only)
+	SocketOwner string
+	SocketGroup string
+	// AppName - when SocketDirectory is empty the socket goes in $XDG_RUNTIME_DIR/<AppName> (if set) rather than /tmp/
+	AppName string
+	// DirectoryMode - permissions SocketDirectory is created with, defaults to 0700. An existing directory
+	// that other users can write to, beyond what this allows, is refused (unix only).
+	DirectoryMode os.FileMode
+	// Manifest - writes a json Manifest next to the socket file so the server can be found with Discover
+	Manifest bool
+	// AppVersion - version of the application, recorded in the manifest
+	AppVersion string
+	// Seqpacket - listen on a SOCK_SEQPACKET socket (SeqpacketTransport) as well as the stream socket,
+	// clients use it if they set ClientConfig.Seqpacket. Ignored when Transport is set (linux)
+	Seqpacket bool
+	// DrainTimeout - how long Handoff waits for clients to move to the new process before closing
+	// their connections, defaults to 30s
+	DrainTimeout time.Duration
+	// ReleaseStderr - when the server was launched by a client's AutoStart Command, its stderr is
+	// the client's pipe. Once the server listens the pipe is swapped for the null device so the
+	// client can stop reading, nothing changes if stderr isn't a pipe or the server wasn't auto-started.
+	ReleaseStderr bool
 }
 
 // ClientConfig - used to pass configuation overrides to ClientStart()
@@ -94,4 +237,29 @@ type ClientConfig struct {
 	Timeout         float64
 	RetryTimer      time.Duration
 	PskConfig       tls.PSKConfig
+	// Abstract - connect to a linux abstract socket instead of a socket file, the same as prefixing the name with @
+	Abstract bool
+	// PeerPolicy - checks the credentials of the server process before the tls handshake
+	PeerPolicy PeerPolicy
+	// Transport - connects to the server, it must match the server's transport, defaults to
+	// unix sockets (named pipes on windows) in SocketDirectory
+	Transport Transport
+	// SharedMemorySize - size of the shared memory ring used to send large messages to the server,
+	// 0 turns it off. Both sides have to enable it (linux unix sockets only).
+	SharedMemorySize int
+	// SharedMemoryThreshold - messages of at least this many bytes go through shared memory, defaults to 64KiB
+	SharedMemoryThreshold int
+	// AppName - when SocketDirectory is empty the client looks in $XDG_RUNTIME_DIR/<AppName> (if set) rather than /tmp/
+	AppName string
+	// DirectoryOwner - user name or uid that must own the server's directory, defaults to this user
+	// for $XDG_RUNTIME_DIR/<AppName> and isn't checked otherwise (unix only)
+	DirectoryOwner string
+	// DirectoryMode - permissions the server's directory may have when DirectoryOwner is checked, eg. the
+	// 0770 a server shares with a group through its own DirectoryMode. Defaults to 0700 (unix only).
+	DirectoryMode os.FileMode
+	// AutoStart - starts the server if nobody is listening when the client first dials, nil turns it off
+	AutoStart *AutoStart
+	// Seqpacket - connect to the server's SOCK_SEQPACKET socket (SeqpacketTransport) when it has one,
+	// otherwise the stream socket. Ignored when Transport is set (linux)
+	Seqpacket bool
 }
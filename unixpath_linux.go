@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package ipc
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+const maxSunPath = 108 // size of sockaddr_un.sun_path
+
+// shortenSocketPath - linux reaches long paths through /proc, see unixAddress
+func shortenSocketPath(path string, directory string, name string) string {
+	return path
+}
+
+// unixAddress - the address to bind or connect to for the socket file at path. Paths that don't fit
+// in sun_path go through /proc/self/fd/<directory fd>/, done closes the directory once the bind or
+// connect has finished.
+func unixAddress(path string) (string, func(), error) {
+	if len(path) < maxSunPath {
+		return path, func() {}, nil
+	}
+
+	fd, err := unix.Open(filepath.Dir(path), unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", nil, err
+	}
+
+	address := fmt.Sprintf("/proc/self/fd/%d/%s", fd, filepath.Base(path))
+	if len(address) >= maxSunPath {
+		unix.Close(fd)
+		return "", nil, fmt.Errorf("%w: %s", ErrSocketPathTooLong, path)
+	}
+
+	return address, func() { unix.Close(fd) }, nil
+}
@@ -1,5 +1,75 @@
 package ipc
 
+import "time"
+
 const version = 2 // ipc package version
 
 const maxMsgSize = 3145728 // 3Mb  - Maximum bytes allowed for each message
+
+const derivedKeySize = 32 // size of a passphrase derived psk
+
+const saltDomain = "psk-local-ipc/passphrase\x00" // mixed into the salt before the ipc name
+
+// default passphrase kdf cost parameters
+const (
+	scryptN       = 32768
+	scryptR       = 8
+	scryptP       = 1
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+const handshakeTimeout = 10 * time.Second // default time allowed for a server side handshake
+
+const maxPendingHandshakes = 32 // default number of concurrent server side handshakes
+
+// default lockout policy values
+const (
+	lockoutMaxFailures = 3
+	lockoutBaseDelay   = time.Second
+	lockoutMaxDelay    = 5 * time.Minute
+	lockoutResetAfter  = 15 * time.Minute
+)
+
+const dialTimeout = 2 * time.Second // time allowed for each Transport.Dial attempt
+
+const memoryPipeSize = 256 * 1024 // bytes buffered in each direction of a MemoryTransport connection
+
+const maxPassedFiles = 16 // files that can be sent with one message
+
+const maxQueuedFiles = 64 // recieved files waiting for their message, any more are closed
+
+const sharedMemoryThreshold = 64 * 1024 // default size from which messages go through shared memory
+
+const maxSharedMemorySize = 1 << 30 // largest shared memory ring that is created or mapped
+
+const channelEnv = "PSK_LOCAL_IPC_CHANNEL" // fd numbers of the SpawnWithChannel socket and psk pipe
+
+const channelIdentity = "psk-local-ipc-channel" // psk identity used by SpawnWithChannel
+
+const staleSocketTimeout = time.Second // time allowed to find out if an existing socket has a server behind it
+
+const instanceTimeout = 10 * time.Second // time a second instance waits for the primary to take its arguments
+
+const directoryMode = 0700 // default permissions of a socket directory created by the server
+
+const maxNameLength = 100 // longest ipc name, short enough for an abstract socket address
+
+const manifestMarker = "manifest" // value of the psk_local_ipc field in every manifest
+
+const refusedRetryDelay = 10 * time.Millisecond // first retry after a socket file refused the dial, it doubles each time
+
+const autoStartTimeout = 10 * time.Second // default time AutoStart waits for the server to listen
+
+const autoStartPoll = 100 * time.Millisecond // how often AutoStart checks the server hasn't exited
+
+const maxStderrLength = 4096 // bytes of the server's stderr included in an AutoStartError
+
+const autoStartEnv = "PSK_LOCAL_IPC_AUTOSTART" // set for a server launched by AutoStart, its stderr is the client's pipe
+
+const handoffEnv = "PSK_LOCAL_IPC_LISTENERS" // <name>=<fd> of the listeners passed by Server.Handoff
+
+const drainTimeout = 30 * time.Second // default time Handoff waits for clients to reconnect
+
+const maxPacketPayload = 32 * 1024 // largest packet written on seqpacket sockets